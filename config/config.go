@@ -1,7 +1,6 @@
 package config
 
 import (
-	"encoding/json"
 	"flag"
 	"os"
 	"regexp"
@@ -17,7 +16,13 @@ const (
 	FiberLogFormat = "${ip} - [${time}] ${method} ${url} ${status} ${referer} ${ua}\n"
 	WebpMax        = 16383
 	AvifMax        = 65536
-	RemoteRaw      = "remote-raw"
+	JxlEffort      = 7 // libvips default
+
+	SizePolicyReject = "reject"
+	SizePolicySnap   = "snap"
+
+	UnsignedPolicyOriginal = "original"
+	UnsignedPolicyForbid   = "forbid"
 
 	SampleConfig = `
 {
@@ -28,6 +33,7 @@ const (
   "EXHAUST_PATH": "./exhaust",
   "ALLOWED_TYPES": ["jpg","png","jpeg","bmp","svg"],
   "ENABLE_AVIF": false,
+  "ENABLE_JXL": false,
   "ENABLE_EXTRA_PARAMS": false
 }`
 
@@ -42,6 +48,7 @@ Type=simple
 StandardError=journal
 WorkingDirectory=/opt/webps
 ExecStart=/opt/webps/webp-server --config /opt/webps/config.json
+ExecReload=/bin/kill -HUP $MAINPID
 Restart=always
 RestartSec=3s
 
@@ -53,7 +60,9 @@ var (
 	ConfigPath  string
 	Jobs        int
 	DumpSystemd bool
-	DumpConfig  bool
+	WatchFile   bool
+	DumpConfig  string
+	CheckConfig bool
 	ShowVersion bool
 	ProxyMode   bool
 	Prefetch    bool
@@ -62,53 +71,178 @@ var (
 	WriteLock   = cache.New(5*time.Minute, 10*time.Minute)
 )
 
-const Metadata = "metadata"
+// Metadata and RemoteRaw are the directory names of metadata and downloaded remote images under EXHAUST_PATH,
+// older versions kept them in working directory.
+const (
+	Metadata  = "metadata"
+	RemoteRaw = "remote-raw"
+)
 
 type MetaFile struct {
 	Id       string `json:"id"`       // hash of below path️, also json file name id.webp
 	Path     string `json:"path"`     // local: path with width and height, proxy: full url
 	Checksum string `json:"checksum"` // hash of original file or hash(etag). Use this to identify changes
+
+	Placeholders map[string]string `json:"placeholders,omitempty"` // lqip, blurhash or thumbhash made for this checksum
 }
 
 type jsonFile struct {
-	Host              string   `json:"HOST"`
-	Port              string   `json:"PORT"`
-	ImgPath           string   `json:"IMG_PATH"`
-	Quality           int      `json:"QUALITY,string"`
-	AllowedTypes      []string `json:"ALLOWED_TYPES"`
-	ExhaustPath       string   `json:"EXHAUST_PATH"`
-	EnableAVIF        bool     `json:"ENABLE_AVIF"`
-	EnableExtraParams bool     `json:"ENABLE_EXTRA_PARAMS"`
+	Host              string               `json:"HOST"`
+	Port              string               `json:"PORT"`
+	ImgPath           string               `json:"IMG_PATH"`
+	Quality           int                  `json:"QUALITY,string"`
+	AllowedTypes      []string             `json:"ALLOWED_TYPES"`
+	ExhaustPath       string               `json:"EXHAUST_PATH"`
+	EnableAVIF        bool                 `json:"ENABLE_AVIF"`
+	EnableJXL         bool                 `json:"ENABLE_JXL"`
+	EnableExtraParams bool                 `json:"ENABLE_EXTRA_PARAMS"`
+	EnableFormatParam bool                 `json:"ENABLE_FORMAT_PARAM"` // allow ?format= to force output format
+	EnablePlaceholder bool                 `json:"ENABLE_PLACEHOLDERS"` // allow ?placeholder= to get lqip, blurhash or thumbhash of image
+	EnableClientHints bool                 `json:"ENABLE_CLIENT_HINTS"` // size images by Sec-CH-DPR, Sec-CH-Width and Sec-CH-Viewport-Width
+	MaxDpr            float64              `json:"MAX_DPR"`             // dpr param and hint are capped at it
+	SaveDataQuality   int                  `json:"SAVE_DATA_QUALITY"`   // quality for Save-Data: on requests, 0 ignores Save-Data
+	SaveDataMaxWidth  int                  `json:"SAVE_DATA_MAX_WIDTH"` // Save-Data: on images are downscaled to fit, 0 is no limit
+	SaveDataMaxHeight int                  `json:"SAVE_DATA_MAX_HEIGHT"`
+	AllowedWidths     []int                `json:"ALLOWED_WIDTHS"`  // only these widths can be asked
+	AllowedHeights    []int                `json:"ALLOWED_HEIGHTS"` // only these heights can be asked
+	SizeStep          int                  `json:"SIZE_STEP"`       // without allowed list, sizes must be MIN_SIZE plus a multiple of it
+	MinSize           int                  `json:"MIN_SIZE"`
+	MaxSize           int                  `json:"MAX_SIZE"`
+	SizePolicy        string               `json:"SIZE_POLICY"`     // reject or snap sizes not allowed
+	SigningKeys       []string             `json:"SIGNING_KEYS"`    // extra params need a signature by one of them, first one is used by sign command
+	UnsignedPolicy    string               `json:"UNSIGNED_POLICY"` // original or forbid requests without valid signature
+	MaxBlur           float64              `json:"MAX_BLUR"`        // blur param is limited to it, 0 disables blur
+	MaxSharpen        float64              `json:"MAX_SHARPEN"`     // sharpen param is limited to it, 0 disables sharpen
+	MaxAdjustment     float64              `json:"MAX_ADJUSTMENT"`  // brightness, contrast and saturation factors are limited to it, 0 disables them
+	Presets           map[string]Preset    `json:"PRESETS"`
+	Watermarks        map[string]Watermark `json:"WATERMARKS"`
+	Watermark         string               `json:"WATERMARK"`           // name in WATERMARKS stamped on every image, rules can change it
+	Text              TextOverlay          `json:"TEXT"`                // rendered on every image, rules can change it
+	PresetsOnly       bool                 `json:"PRESETS_ONLY"`        // refuse params other than preset
+	WebpQuality       int                  `json:"WEBP_QUALITY,string"` // default: QUALITY
+	AvifQuality       int                  `json:"AVIF_QUALITY,string"` // default: QUALITY
+	JxlQuality        int                  `json:"JXL_QUALITY,string"`  // default: QUALITY
+	WebpMethod        int                  `json:"WEBP_METHOD"`         // 0(fast)-6(slow), aka ReductionEffort
+	WebpNearLossless  bool                 `json:"WEBP_NEAR_LOSSLESS"`
+	AvifEffort        int                  `json:"AVIF_EFFORT"`     // 0(fast)-9(slow)
+	JxlEffort         int                  `json:"JXL_EFFORT"`      // 1(fast)-9(slow)
+	AutoLossless      bool                 `json:"AUTO_LOSSLESS"`   // also try lossless for PNG and GIF graphics, keep the smaller
+	MetadataPath      string               `json:"METADATA_PATH"`   // default: EXHAUST_PATH/metadata
+	RemoteRawPath     string               `json:"REMOTE_RAW_PATH"` // default: EXHAUST_PATH/remote-raw
+	Rules             []Rule               `json:"RULES"`
+	Sites             []siteFile           `json:"SITES"`
 }
 
 func init() {
-	flag.StringVar(&ConfigPath, "config", "config.json", "/path/to/config.json. (Default: ./config.json)")
+	flag.StringVar(&ConfigPath, "config", "config.json", "/path/to/config.json, .yaml, .yml and .toml are supported as well. (Default: ./config.json)")
 	flag.BoolVar(&Prefetch, "prefetch", false, "Prefetch and convert image to webp")
 	flag.IntVar(&Jobs, "jobs", runtime.NumCPU(), "Prefetch thread, default is all.")
-	flag.BoolVar(&DumpConfig, "dump-config", false, "Print sample config.json")
+	flag.Var(dumpFlag{format: &DumpConfig}, "dump-config", "Print sample config.json, use --dump-config=yaml or --dump-config=toml for other formats")
+	flag.BoolVar(&CheckConfig, "check-config", false, "Validate config and exit, exit code is non-zero if there is any problem.")
+	flag.BoolVar(&WatchFile, "watch-config", false, "Reload config when config file changes, SIGHUP always reloads config.")
 	flag.BoolVar(&DumpSystemd, "dump-systemd", false, "Print sample systemd service file.")
 	flag.BoolVar(&ShowVersion, "V", false, "Show version information.")
+	registerOverrideFlags()
+}
+
+func defaultConfig() jsonFile {
+	return jsonFile{
+		Host:           "127.0.0.1",
+		Port:           "3333",
+		ImgPath:        "./pics",
+		Quality:        80,
+		AllowedTypes:   []string{"jpg", "png", "jpeg", "bmp", "gif", "svg"},
+		ExhaustPath:    "./exhaust",
+		JxlEffort:      JxlEffort,
+		MaxDpr:         3,
+		MaxBlur:        20,
+		MaxSharpen:     10,
+		MaxAdjustment:  3,
+		SizePolicy:     SizePolicyReject,
+		UnsignedPolicy: UnsignedPolicyOriginal,
+	}
 }
 
+// LoadConfig builds Config from defaults, config file, WEBP_ env and command line flags, later ones win.
+// Config file is optional unless --config is given explicitly.
+// Every problem found in config is printed and the process exits, so a broken config never starts serving.
 func LoadConfig() {
-	jsonObject, err := os.Open(ConfigPath)
-	if err != nil {
-		log.Fatal(err)
+	c, resolved, problems := loadConfig()
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Errorf("Invalid config: %v", problem)
+		}
+		log.Fatalf("Found %d problem(s) in config %s, please fix them and try again", len(problems), ConfigPath)
 	}
-	decoder := json.NewDecoder(jsonObject)
-	_ = decoder.Decode(&Config)
-	_ = jsonObject.Close()
+	Config = c
+	sites = resolved
 	switchProxyMode()
 }
 
+func loadConfig() (jsonFile, []Site, []error) {
+	var (
+		c        = defaultConfig()
+		problems []error
+	)
+	data, err := os.ReadFile(ConfigPath)
+	if err == nil {
+		data, err = toJSON(data, configFormat(ConfigPath))
+	}
+	if err == nil {
+		problems = append(problems, decodeStrict(data, &c)...)
+	} else if os.IsNotExist(err) && !isFlagSet("config") {
+		log.Warnf("Config file %s not found, using defaults and environment variables", ConfigPath)
+	} else {
+		problems = append(problems, err)
+	}
+	problems = append(problems, applyOverrides(&c)...)
+	resolveDirs(&c)
+	problems = append(problems, validateConfig(&c)...)
+	resolved, siteProblems := resolveSites(&c)
+	return c, resolved, append(problems, siteProblems...)
+}
+
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
 type ExtraParams struct {
-	Width  int // in px
-	Height int // in px
+	Width         int    // in px
+	Height        int    // in px
+	Fit           string // how to fit into width x height, cover if empty
+	Background    string // rrggbbaa, letterbox color of contain
+	Gravity       string // part of image kept by cover, or where contain puts image, attention if empty
+	FocusX        float64
+	FocusY        float64 // focal point in fractions of width and height, used when gravity is focus
+	Dpr           float64 // multiplies width and height, resolved before encoding so it's always 0 there
+	Quality       int     // overrides quality of site, e.g. for Save-Data
+	MaxWidth      int
+	MaxHeight     int     // image is downscaled to fit, never upscaled
+	Rotate        int     // clockwise, 90, 180 or 270, applied after EXIF orientation
+	Flip          bool    // mirrors top to bottom
+	Flop          bool    // mirrors left to right
+	NoAutoRotate  bool    // EXIF orientation is ignored, for images with a wrong tag
+	Blur          float64 // sigma of gaussian blur
+	Sharpen       float64 // sigma of sharpening
+	Grayscale     bool
+	Brightness    float64 // factors, 1 is unchanged, 0 when not given
+	Contrast      float64
+	Saturation    float64
+	Tint          string      // rrggbb, black stays black and white becomes this color
+	Watermark     Watermark   // set by server only, from site, rule or preset
+	WatermarkHash string      // changes with watermark file and settings, so variants are re-encoded
+	Crop          [4]float64  // x, y, width, height of source in px, or in fractions when all are at most 1
+	Text          TextOverlay // from site, rule or signed text param
+	TextHash      string      // only set when read back from cache id, ExtraParamsKey hashes Text otherwise
 }
 
 func switchProxyMode() {
 	matched, _ := regexp.MatchString(`^https?://`, Config.ImgPath)
-	if matched {
-		ProxyMode = true
-	}
+	ProxyMode = matched
 }
@@ -1,13 +1,20 @@
 package config
 
 import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path"
+	"reflect"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestMain(m *testing.M) {
-	ConfigPath = "../config.json"
+	// paths in config.json are relative to project root
+	_ = os.Chdir("..")
+	ConfigPath = "config.json"
 	m.Run()
 	ConfigPath = "config.json"
 	Config.ImgPath = "./pics"
@@ -29,3 +36,403 @@ func TestSwitchProxyMode(t *testing.T) {
 	switchProxyMode()
 	assert.True(t, ProxyMode)
 }
+
+func TestLoadConfigOverride(t *testing.T) {
+	defer func() {
+		flagOverrides = map[string]string{}
+	}()
+	t.Setenv("WEBP_QUALITY", "70")
+	t.Setenv("WEBP_PORT", "4444")
+	t.Setenv("WEBP_ALLOWED_TYPES", "jpg, png")
+	t.Setenv("WEBP_ENABLE_AVIF", "true")
+	assert.Nil(t, flag.Set("port", "5555"))
+	assert.Nil(t, flag.Set("enable-extra-params", "true"))
+
+	LoadConfig()
+	// env overrides file
+	assert.Equal(t, 70, Config.Quality)
+	assert.Equal(t, []string{"jpg", "png"}, Config.AllowedTypes)
+	assert.True(t, Config.EnableAVIF)
+	// flag overrides env
+	assert.Equal(t, "5555", Config.Port)
+	assert.True(t, Config.EnableExtraParams)
+	// untouched value from file
+	assert.Equal(t, "./pics", Config.ImgPath)
+}
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	ConfigPath = "not-exist.json"
+	defer func() {
+		ConfigPath = "config.json"
+	}()
+	t.Setenv("WEBP_IMG_PATH", "./pics/dir1")
+
+	LoadConfig()
+	assert.Equal(t, "3333", Config.Port)
+	assert.Equal(t, 80, Config.Quality)
+	assert.Equal(t, "./pics/dir1", Config.ImgPath)
+}
+
+func TestSetField(t *testing.T) {
+	var c jsonFile
+	v := reflect.ValueOf(&c).Elem()
+	assert.Nil(t, setField(v.FieldByName("Quality"), " 90"))
+	assert.Equal(t, 90, c.Quality)
+	assert.Nil(t, setField(v.FieldByName("AllowedTypes"), `["gif","svg"]`))
+	assert.Equal(t, []string{"gif", "svg"}, c.AllowedTypes)
+	assert.NotNil(t, setField(v.FieldByName("Quality"), "high"))
+	assert.NotNil(t, setField(v.FieldByName("EnableAVIF"), "maybe"))
+	assert.Nil(t, setField(v.FieldByName("AllowedWidths"), "100, 200"))
+	assert.Equal(t, []int{100, 200}, c.AllowedWidths)
+}
+
+func TestDecodeStrict(t *testing.T) {
+	c := defaultConfig()
+	problems := decodeStrict([]byte(`{"QUALITY": true, "IMG_PATHS": "./pics", "ENABLE_AVIF": "yes", "PORT": "1234"}`), &c)
+	assert.Len(t, problems, 3)
+	assert.Contains(t, problems[0].Error(), "ENABLE_AVIF: expected a boolean")
+	assert.Contains(t, problems[1].Error(), "IMG_PATHS: unknown key")
+	assert.Contains(t, problems[2].Error(), "QUALITY: expected a number")
+	// valid keys are still decoded
+	assert.Equal(t, "1234", c.Port)
+
+	// QUALITY can be a number or a string
+	assert.Empty(t, decodeStrict([]byte(`{"QUALITY": 70}`), &c))
+	assert.Equal(t, 70, c.Quality)
+	assert.Empty(t, decodeStrict([]byte(`{"QUALITY": "75"}`), &c))
+	assert.Equal(t, 75, c.Quality)
+	// so can QUALITY of presets, like that of rules
+	assert.Empty(t, decodeStrict([]byte(`{"PRESETS": {"thumb": {"WIDTH": 200, "QUALITY": "70"}, "card": {"QUALITY": 60}}}`), &c))
+	assert.Equal(t, 70, c.Presets["thumb"].Quality)
+	assert.Equal(t, 60, c.Presets["card"].Quality)
+
+	problems = decodeStrict([]byte(`{"QUALITY": "80",}`), &c)
+	assert.Len(t, problems, 1)
+	assert.Contains(t, problems[0].Error(), "invalid JSON")
+}
+
+func TestValidateConfig(t *testing.T) {
+	c := defaultConfig()
+	assert.Empty(t, validateConfig(&c))
+
+	c.Quality = 0
+	c.Port = "http"
+	c.AllowedTypes = nil
+	c.ImgPath = "./not-exist"
+	c.ExhaustPath = "./config.json/exhaust"
+	problems := validateConfig(&c)
+	assert.Len(t, problems, 5)
+
+	for _, imgPath := range []string{"ftp://example.com", "https://", "http//example.com"} {
+		assert.NotNil(t, checkImgPath(imgPath), imgPath)
+	}
+	assert.Nil(t, checkImgPath("https://docs.webp.sh"))
+}
+
+func TestReloadConfig(t *testing.T) {
+	LoadConfig()
+	t.Setenv("WEBP_QUALITY", "60")
+	assert.Nil(t, ReloadConfig())
+	assert.Equal(t, 60, Config.Quality)
+
+	// invalid config is refused, current one is kept
+	t.Setenv("WEBP_QUALITY", "0")
+	assert.NotNil(t, ReloadConfig())
+	assert.Equal(t, 60, Config.Quality)
+}
+
+func TestDiffConfig(t *testing.T) {
+	current := defaultConfig()
+	next := defaultConfig()
+	assert.Empty(t, diffConfig(&current, &next))
+
+	next.Quality = 70
+	next.AllowedTypes = []string{"jpg"}
+	assert.Equal(t, []string{"QUALITY: 80 -> 70", "ALLOWED_TYPES: [jpg png jpeg bmp gif svg] -> [jpg]"}, diffConfig(&current, &next))
+
+	next = defaultConfig()
+	next.SigningKeys = []string{"0123456789abcdef"}
+	assert.Equal(t, []string{"SIGNING_KEYS: changed"}, diffConfig(&current, &next))
+
+	// keys of sites aren't printed either
+	next = defaultConfig()
+	next.Sites = []siteFile{{"HOSTS": json.RawMessage(`["img.example.com"]`), "SIGNING_KEYS": json.RawMessage(`["0123456789abcdef"]`)}}
+	assert.Equal(t, []string{"SITES: changed"}, diffConfig(&current, &next))
+}
+
+func TestResolveSites(t *testing.T) {
+	c := defaultConfig()
+	problems := decodeStrict([]byte(`{"SITES": [
+		{"HOSTS": ["img.a.com", "A.com"], "QUALITY": "60", "IMG_PATH": "./pics/dir1"},
+		{"NAME": "b", "HOSTS": ["*.b.com"], "IMG_PATH": "https://docs.webp.sh", "EXHAUST_PATH": "/tmp/b", "ENABLE_AVIF": true}
+	]}`), &c)
+	assert.Empty(t, problems)
+	resolveDirs(&c)
+
+	resolved, problems := resolveSites(&c)
+	assert.Empty(t, problems)
+	assert.Len(t, resolved, 2)
+
+	a := resolved[0]
+	assert.Equal(t, "img.a.com", a.Name)
+	assert.Equal(t, []string{"img.a.com", "a.com"}, a.Hosts)
+	assert.Equal(t, 60, a.Quality)
+	assert.Equal(t, "exhaust/img.a.com", a.ExhaustPath)
+	assert.Equal(t, c.AllowedTypes, a.AllowedTypes)
+	assert.False(t, a.ProxyMode)
+
+	assert.Equal(t, "exhaust/metadata/img.a.com", a.MetadataPath)
+	assert.Equal(t, "exhaust/remote-raw/img.a.com", a.RemoteRawPath)
+
+	b := resolved[1]
+	assert.Equal(t, "/tmp/b", b.ExhaustPath)
+	assert.Equal(t, 80, b.Quality)
+	assert.True(t, b.EnableAVIF)
+	assert.True(t, b.ProxyMode)
+
+	sites = resolved
+	defer func() {
+		sites = nil
+	}()
+	assert.Equal(t, "img.a.com", SiteFor("A.com:3333").Name)
+	assert.Equal(t, "b", SiteFor("cdn.b.com").Name)
+	assert.Equal(t, "", SiteFor("b.com").Name)
+	assert.Equal(t, Config.ImgPath, SiteFor("localhost").ImgPath)
+}
+
+func TestResolveSitesProblems(t *testing.T) {
+	c := defaultConfig()
+	problems := decodeStrict([]byte(`{"SITES": [
+		{"HOSTS": ["a.com"], "PORT": "80", "QUALITI": "60"},
+		{"QUALITY": "60"},
+		{"HOSTS": ["a.com"], "IMG_PATH": "./not-exist"}
+	]}`), &c)
+	assert.Empty(t, problems)
+
+	_, problems = resolveSites(&c)
+	assert.Len(t, problems, 5)
+	assert.Equal(t, "SITES[0].PORT: can't be set per site", problems[0].Error())
+	assert.Equal(t, "SITES[0].QUALITI: unknown key", problems[1].Error())
+	assert.Equal(t, "SITES[1].HOSTS: at least one host is required", problems[2].Error())
+	assert.Equal(t, "SITES[2].HOSTS: a.com is already served by SITES[0]", problems[3].Error())
+	assert.Contains(t, problems[4].Error(), "SITES[2].IMG_PATH")
+}
+
+func TestApplyRule(t *testing.T) {
+	c := defaultConfig()
+	problems := decodeStrict([]byte(`{"RULES": [
+		{"NAME": "avatars", "PREFIX": "/avatars/", "QUALITY": "60", "FORMATS": ["avif", "webp"]},
+		{"GLOB": "/products/*.png", "LOSSLESS": true, "AUTO_LOSSLESS": true, "ENABLE_EXTRA_PARAMS": true},
+		{"PREFIX": "/raw/", "FORMATS": []}
+	]}`), &c)
+	assert.Empty(t, problems)
+	assert.Empty(t, validateRules(c.Rules))
+
+	site := Site{jsonFile: c}
+	site.ApplyRule("/avatars/1.jpg")
+	assert.Equal(t, "avatars", site.RuleName)
+	assert.Equal(t, 60, site.Quality)
+	assert.True(t, site.FormatEnabled("avif"))
+	assert.False(t, site.ConversionDisabled())
+
+	site = Site{jsonFile: c}
+	site.ApplyRule("/products/a/1.png")
+	assert.Equal(t, "", site.RuleName)
+	site.ApplyRule("/products/1.png")
+	assert.Equal(t, "/products/*.png", site.RuleName)
+	assert.True(t, site.Lossless)
+	assert.True(t, site.AutoLossless)
+	assert.True(t, site.EnableExtraParams)
+	assert.Equal(t, 80, site.Quality)
+	assert.True(t, site.FormatEnabled("webp"))
+	assert.False(t, site.FormatEnabled("avif"))
+	assert.False(t, site.FormatEnabled("jxl"))
+
+	site = Site{jsonFile: c}
+	site.ApplyRule("/raw/1.png")
+	assert.True(t, site.ConversionDisabled())
+	assert.False(t, site.FormatEnabled("webp"))
+}
+
+func TestValidateRules(t *testing.T) {
+	c := defaultConfig()
+	problems := decodeStrict([]byte(`{"RULES": [{"PREFIX": "/a/", "QUALITI": "60"}, {"PREFIX": "/a/", "LOSSLESS": "yes"}]}`), &c)
+	assert.Len(t, problems, 2)
+	assert.Equal(t, "RULES[0].QUALITI: unknown key", problems[0].Error())
+	assert.Equal(t, "RULES[1].LOSSLESS: expected a boolean, got \"yes\"", problems[1].Error())
+
+	problems = validateRules([]Rule{
+		{Name: "empty"},
+		{Prefix: "raw/", Glob: "[", Quality: 101, Formats: []string{"gif"}},
+	})
+	assert.Len(t, problems, 5)
+}
+
+func TestValidatePresets(t *testing.T) {
+	c := defaultConfig()
+	problems := decodeStrict([]byte(`{"PRESETS": {"thumb": {"WIDTH": 200, "HEIGHT": 200, "FIT": "cover"}, "card": {"WIDE": 300}}}`), &c)
+	assert.Len(t, problems, 1)
+	assert.Equal(t, "PRESETS.card.WIDE: unknown key", problems[0].Error())
+	assert.Equal(t, Preset{Width: 200, Height: 200, Fit: "cover"}, c.Presets["thumb"])
+
+	problems = validatePresets(map[string]Preset{
+		"thumb":    {Width: 200, Fit: "cover", Gravity: "north"},
+		"bad name": {Width: -1, Fit: "crop", Background: "red", Focus: "2,0", Quality: 101, Tint: "red"},
+	})
+	assert.Len(t, problems, 7)
+	assert.Equal(t, "PRESETS.bad name: name can only contain letters, digits, '.', '-' and '_'", problems[0].Error())
+
+	problems = validatePresets(map[string]Preset{"hero": {Width: 1200, Gravity: "north", Focus: "0.5,0.3"}})
+	assert.Len(t, problems, 1)
+	assert.Equal(t, "PRESETS.hero: GRAVITY can't be used with FOCUS", problems[0].Error())
+}
+
+func TestValidateWatermarks(t *testing.T) {
+	logo := path.Join(t.TempDir(), "logo.png")
+	assert.Nil(t, os.WriteFile(logo, []byte("png"), 0600))
+
+	c := defaultConfig()
+	c.Watermarks = map[string]Watermark{
+		"logo": {Path: logo, Gravity: "southeast", Margin: 10, Opacity: 0.5, Scale: 0.2},
+		"bad":  {Path: "./not-exist.png", Gravity: "middle", Opacity: 2},
+		"busy": {Path: logo, Gravity: "attention"},
+	}
+	c.Watermark = "logo"
+	removed := ""
+	c.Rules = []Rule{{Prefix: "/raw/", Watermark: &removed}, {Prefix: "/a/", Watermark: &c.Watermark}}
+	c.Presets = map[string]Preset{"thumb": {Width: 100, Watermark: "missing"}}
+	problems := validateWatermarks(&c)
+	assert.Len(t, problems, 5)
+	assert.Equal(t, "WATERMARKS.busy.GRAVITY: unknown value \"attention\", supported values are center, north, south, east, west, northeast, northwest, southeast, southwest", problems[3].Error())
+	assert.Equal(t, "PRESETS.thumb.WATERMARK: unknown watermark \"missing\"", problems[4].Error())
+
+	site := Site{jsonFile: c}
+	site.ApplyRule("/raw/a.jpg")
+	assert.Equal(t, "", site.Watermark)
+}
+
+func TestRuleText(t *testing.T) {
+	c := defaultConfig()
+	problems := decodeStrict([]byte(`{"TEXT": {"TEXT": "© Shop", "SIZE": 20}, "RULES": [{"PREFIX": "/raw/", "TEXT": {}}, {"PREFIX": "/sku/", "TEXT": {"TEXT": "SKU", "COLOUR": "fff"}}]}`), &c)
+	assert.Len(t, problems, 1)
+	assert.Equal(t, "RULES[1].TEXT.COLOUR: unknown key", problems[0].Error())
+
+	site := Site{jsonFile: c}
+	site.ApplyRule("/a.jpg")
+	assert.Equal(t, TextOverlay{Text: "© Shop", Size: 20}, site.Text)
+	site.ApplyRule("/raw/a.jpg")
+	assert.Equal(t, TextOverlay{}, site.Text)
+
+	problems = validateText("TEXT", TextOverlay{Text: "a", Size: -1, Color: "white", Gravity: "top"})
+	assert.Len(t, problems, 3)
+}
+
+func TestConfigFormats(t *testing.T) {
+	assert.Equal(t, "yaml", configFormat("/etc/webp/config.YML"))
+	assert.Equal(t, "toml", configFormat("config.toml"))
+	assert.Equal(t, "json", configFormat("config.json"))
+
+	var expected jsonFile
+	assert.Empty(t, decodeStrict([]byte(SampleConfig), &expected))
+	for _, format := range []string{"yaml", "toml"} {
+		data, err := toJSON([]byte(SampleConfigOf(format)), format)
+		assert.Nil(t, err)
+		var c jsonFile
+		assert.Empty(t, decodeStrict(data, &c), format)
+		assert.Equal(t, expected, c, format)
+	}
+
+	data, err := toJSON([]byte("RULES:\n  - PREFIX: /raw/\n    FORMATS: []\n    QUALITY: 60\n"), "yaml")
+	assert.Nil(t, err)
+	var c jsonFile
+	assert.Empty(t, decodeStrict(data, &c))
+	assert.Equal(t, 60, c.Rules[0].Quality)
+	assert.True(t, c.Rules[0].Formats != nil && len(c.Rules[0].Formats) == 0)
+
+	_, err = toJSON([]byte("QUALITY = "), "toml")
+	assert.NotNil(t, err)
+}
+
+func TestLoadConfigYAML(t *testing.T) {
+	ConfigPath = path.Join(t.TempDir(), "config.yaml")
+	defer func() {
+		ConfigPath = "config.json"
+	}()
+	assert.Nil(t, os.WriteFile(ConfigPath, []byte(SampleConfigYAML), 0600))
+
+	LoadConfig()
+	assert.Equal(t, 80, Config.Quality)
+	assert.Equal(t, "./pics", Config.ImgPath)
+}
+
+func TestDumpFlag(t *testing.T) {
+	var format string
+	d := dumpFlag{format: &format}
+	assert.Nil(t, d.Set("true"))
+	assert.Equal(t, "json", format)
+	assert.Nil(t, d.Set("yml"))
+	assert.Equal(t, "yaml", format)
+	assert.NotNil(t, d.Set("xml"))
+}
+
+func TestResolveDirs(t *testing.T) {
+	c := defaultConfig()
+	resolveDirs(&c)
+	assert.Equal(t, "exhaust/metadata", c.MetadataPath)
+	assert.Equal(t, "exhaust/remote-raw", c.RemoteRawPath)
+
+	c = defaultConfig()
+	c.MetadataPath = "/var/cache/webp/metadata"
+	resolveDirs(&c)
+	assert.Equal(t, "/var/cache/webp/metadata", c.MetadataPath)
+}
+
+func TestMigrateDir(t *testing.T) {
+	var (
+		src = path.Join(t.TempDir(), "metadata")
+		dst = path.Join(t.TempDir(), "exhaust", "metadata")
+	)
+	assert.Nil(t, os.MkdirAll(path.Join(src, "site"), 0755))
+	assert.Nil(t, os.WriteFile(path.Join(src, "a.json"), []byte("a"), 0644))
+	assert.Nil(t, os.WriteFile(path.Join(src, "site", "b.json"), []byte("b"), 0644))
+
+	migrateDir(src, dst)
+	_, err := os.Stat(src)
+	assert.True(t, os.IsNotExist(err))
+	buf, _ := os.ReadFile(path.Join(dst, "a.json"))
+	assert.Equal(t, "a", string(buf))
+	buf, _ = os.ReadFile(path.Join(dst, "site", "b.json"))
+	assert.Equal(t, "b", string(buf))
+
+	// nothing to migrate
+	migrateDir(src, dst)
+}
+
+func TestQualityOf(t *testing.T) {
+	site := Site{jsonFile: defaultConfig()}
+	assert.Equal(t, 80, site.QualityOf("webp"))
+	assert.Equal(t, 80, site.QualityOf("avif"))
+
+	site.AvifQuality = 50
+	assert.Equal(t, 80, site.QualityOf("webp"))
+	assert.Equal(t, 50, site.QualityOf("avif"))
+	assert.Equal(t, 80, site.QualityOf("jxl"))
+
+	// quality of rule wins
+	site.Rules = []Rule{{Prefix: "/", Quality: 60}}
+	site.ApplyRule("/a.jpg")
+	assert.Equal(t, 60, site.QualityOf("avif"))
+
+	c := defaultConfig()
+	c.WebpQuality = 101
+	c.WebpMethod = 7
+	c.AvifEffort = -1
+	c.JxlEffort = 0
+	c.MaxDpr = 0.5
+	c.MaxBlur = -1
+	c.MaxAdjustment = 0.5
+	problems := validateConfig(&c)
+	assert.Len(t, problems, 7)
+	// 0 is allowed, it falls back to QUALITY
+	assert.Equal(t, "WEBP_QUALITY: must be 0 (use QUALITY) or between 1 and 100, got 101", problems[0].Error())
+}
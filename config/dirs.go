@@ -0,0 +1,101 @@
+package config
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// resolveDirs puts metadata and remote-raw under EXHAUST_PATH unless they are set explicitly
+func resolveDirs(c *jsonFile) {
+	if c.MetadataPath == "" {
+		c.MetadataPath = path.Join(c.ExhaustPath, Metadata)
+	}
+	if c.RemoteRawPath == "" {
+		c.RemoteRawPath = path.Join(c.ExhaustPath, RemoteRaw)
+	}
+}
+
+// PrepareDirs creates exhaust, metadata and remote-raw directories of every site, files left in
+// ./metadata and ./remote-raw by older versions are moved to the new directories first.
+func PrepareDirs() {
+	migrateDir(Metadata, Config.MetadataPath)
+	migrateDir(RemoteRaw, Config.RemoteRawPath)
+
+	for _, site := range AllSites() {
+		for _, dir := range []string{site.ExhaustPath, site.MetadataPath, site.RemoteRawPath} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				log.Errorf("Can't create %s: %v", dir, err)
+			}
+		}
+	}
+}
+
+// migrateDir moves everything in src to dst, entries already in dst are kept.
+func migrateDir(src, dst string) {
+	srcAbs, _ := filepath.Abs(src)
+	dstAbs, _ := filepath.Abs(dst)
+	if info, err := os.Stat(src); err != nil || !info.IsDir() || srcAbs == dstAbs {
+		return
+	}
+
+	log.Infof("Migrating %s to %s...", src, dst)
+	if err := moveTree(src, dst); err != nil {
+		log.Errorf("Can't migrate %s to %s: %v", src, dst, err)
+		return
+	}
+	if err := os.Remove(src); err != nil {
+		log.Warnf("%s is not empty after migration: %v", src, err)
+	}
+}
+
+func moveTree(src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		from, to := filepath.Join(src, entry.Name()), filepath.Join(dst, entry.Name())
+		if entry.IsDir() {
+			if err := moveTree(from, to); err != nil {
+				return err
+			}
+			_ = os.Remove(from)
+			continue
+		}
+		if _, err := os.Stat(to); err == nil {
+			continue
+		}
+		// rename fails across file systems, e.g. when dst is a docker volume
+		if err := os.Rename(from, to); err != nil {
+			if err := copyFile(from, to); err != nil {
+				return err
+			}
+			_ = os.Remove(from)
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
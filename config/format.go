@@ -0,0 +1,124 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFormats are the supported config file formats, detected by file extension
+var ConfigFormats = []string{"json", "yaml", "toml"}
+
+const (
+	SampleConfigYAML = `
+HOST: 127.0.0.1
+PORT: "3333"
+QUALITY: 80
+IMG_PATH: ./pics
+EXHAUST_PATH: ./exhaust
+ALLOWED_TYPES: [jpg, png, jpeg, bmp, svg]
+ENABLE_AVIF: false
+ENABLE_JXL: false
+ENABLE_EXTRA_PARAMS: false`
+
+	SampleConfigTOML = `
+HOST = "127.0.0.1"
+PORT = "3333"
+QUALITY = 80
+IMG_PATH = "./pics"
+EXHAUST_PATH = "./exhaust"
+ALLOWED_TYPES = ["jpg", "png", "jpeg", "bmp", "svg"]
+ENABLE_AVIF = false
+ENABLE_JXL = false
+ENABLE_EXTRA_PARAMS = false`
+)
+
+// configFormat detects format of config file from its extension, json is the default
+func configFormat(p string) string {
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	default:
+		return "json"
+	}
+}
+
+// toJSON converts a yaml or toml config to json, so every format is decoded and validated the same way.
+func toJSON(data []byte, format string) ([]byte, error) {
+	var c map[string]interface{}
+	switch format {
+	case "yaml":
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return nil, fmt.Errorf("invalid YAML: %w", err)
+		}
+	case "toml":
+		if err := toml.Unmarshal(data, &c); err != nil {
+			return nil, fmt.Errorf("invalid TOML: %w", err)
+		}
+	default:
+		return data, nil
+	}
+	if c == nil {
+		c = map[string]interface{}{}
+	}
+	return json.Marshal(c)
+}
+
+// SampleConfigOf returns sample config in format
+func SampleConfigOf(format string) string {
+	switch format {
+	case "yaml":
+		return SampleConfigYAML
+	case "toml":
+		return SampleConfigTOML
+	default:
+		return SampleConfig
+	}
+}
+
+// dumpFlag works like a bool flag and optionally takes a format, --dump-config or --dump-config=yaml
+type dumpFlag struct {
+	format *string
+}
+
+func (d dumpFlag) String() string {
+	if d.format == nil {
+		return ""
+	}
+	return *d.format
+}
+
+func (d dumpFlag) Set(s string) error {
+	switch s {
+	case "true":
+		s = "json"
+	case "false":
+		s = ""
+	case "yml":
+		s = "yaml"
+	}
+	if s != "" && !isConfigFormat(s) {
+		return fmt.Errorf("unknown format %q, supported formats are %s", s, strings.Join(ConfigFormats, ", "))
+	}
+	*d.format = s
+	return nil
+}
+
+func (d dumpFlag) IsBoolFlag() bool {
+	return true
+}
+
+func isConfigFormat(format string) bool {
+	for _, f := range ConfigFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,144 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// EnvPrefix is prepended to a config key to get the environment variable overriding it,
+// e.g. IMG_PATH can be set with WEBP_IMG_PATH.
+const EnvPrefix = "WEBP_"
+
+// flagOverrides holds config keys set on command line, e.g. --img-path sets IMG_PATH
+var flagOverrides = map[string]string{}
+
+type overrideFlag struct {
+	key    string
+	isBool bool
+}
+
+func (o overrideFlag) String() string {
+	return ""
+}
+
+func (o overrideFlag) Set(s string) error {
+	flagOverrides[o.key] = s
+	return nil
+}
+
+func (o overrideFlag) IsBoolFlag() bool {
+	return o.isBool
+}
+
+// jsonKey returns the key used in config file, "QUALITY" for `json:"QUALITY,string"`
+func jsonKey(field reflect.StructField) string {
+	key, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if key == "-" {
+		return ""
+	}
+	return key
+}
+
+// flagName converts config key to its command line flag, IMG_PATH -> img-path
+func flagName(key string) string {
+	return strings.ToLower(strings.ReplaceAll(key, "_", "-"))
+}
+
+// registerOverrideFlags adds a command line flag for every config key, so fields added to jsonFile
+// can be overridden without extra code.
+func registerOverrideFlags() {
+	t := reflect.TypeOf(jsonFile{})
+	for i := 0; i < t.NumField(); i++ {
+		key := jsonKey(t.Field(i))
+		if key == "" {
+			continue
+		}
+		usage := fmt.Sprintf("Override %s in config file, also settable with env %s%s", key, EnvPrefix, key)
+		flag.Var(overrideFlag{key: key, isBool: t.Field(i).Type.Kind() == reflect.Bool}, flagName(key), usage)
+	}
+}
+
+// applyOverrides sets fields from environment variables and then command line flags,
+// so the precedence is flag > env > config file > defaults.
+func applyOverrides(c *jsonFile) []error {
+	var (
+		problems []error
+		v        = reflect.ValueOf(c).Elem()
+		t        = v.Type()
+	)
+	for i := 0; i < t.NumField(); i++ {
+		key := jsonKey(t.Field(i))
+		if key == "" {
+			continue
+		}
+		if s := os.Getenv(EnvPrefix + key); s != "" {
+			if err := setField(v.Field(i), s); err != nil {
+				problems = append(problems, fmt.Errorf("env %s%s: %w", EnvPrefix, key, err))
+			}
+		}
+		if s, ok := flagOverrides[key]; ok {
+			if err := setField(v.Field(i), s); err != nil {
+				problems = append(problems, fmt.Errorf("flag --%s: %w", flagName(key), err))
+			}
+		}
+	}
+	return problems
+}
+
+// setField parses s into field, lists are comma separated, anything more complex is given as JSON.
+func setField(field reflect.Value, s string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Int:
+		i, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(s))
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(s), "[") {
+			var list []string
+			for _, item := range strings.Split(s, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					list = append(list, item)
+				}
+			}
+			field.Set(reflect.ValueOf(list))
+			return nil
+		}
+		// lists of numbers are comma separated too, e.g. 100,200
+		if kind := field.Type().Elem().Kind(); kind == reflect.Int && !strings.HasPrefix(strings.TrimSpace(s), "[") {
+			return decodeJSON(field, "["+s+"]")
+		}
+		return decodeJSON(field, s)
+	default:
+		return decodeJSON(field, s)
+	}
+	return nil
+}
+
+// decodeJSON decodes s strictly, like values in config file
+func decodeJSON(field reflect.Value, s string) error {
+	problems := decodeValue(field, json.RawMessage(s), false, "value")
+	if len(problems) == 0 {
+		return nil
+	}
+	msgs := make([]string, len(problems))
+	for i, problem := range problems {
+		msgs[i] = problem.Error()
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
@@ -0,0 +1,110 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Fits are the values of fit param, they work like CSS object-fit:
+// cover crops to fill the box, contain letterboxes with background, fill stretches,
+// inside and outside keep the aspect ratio and fit within or cover the box without cropping.
+var Fits = []string{"cover", "contain", "fill", "inside", "outside"}
+
+// Gravities are the values of gravity param, entropy and attention let libvips find the interesting part.
+// A focal point is given with focus param instead, e.g. focus=0.3,0.6
+var Gravities = []string{"center", "north", "south", "east", "west", "northeast", "northwest", "southeast", "southwest", "entropy", "attention"}
+
+// CompassGravities are the gravities that place an overlay, like a watermark, against edges of image
+var CompassGravities = []string{"center", "north", "south", "east", "west", "northeast", "northwest", "southeast", "southwest"}
+
+// Preset is a named set of params, selected with ?preset=name or /_/name/ path prefix.
+// Keys are the same as query params, params given in query are applied on top unless PRESETS_ONLY is set.
+type Preset struct {
+	Width      int     `json:"WIDTH"`
+	Height     int     `json:"HEIGHT"`
+	Fit        string  `json:"FIT"`
+	Background string  `json:"BACKGROUND"`
+	Gravity    string  `json:"GRAVITY"`
+	Focus      string  `json:"FOCUS"` // x,y like focus param
+	Quality    int     `json:"QUALITY,string"`
+	Rotate     int     `json:"ROTATE"`
+	Flip       bool    `json:"FLIP"`
+	Flop       bool    `json:"FLOP"`
+	AutoRotate *bool   `json:"AUTOROTATE"` // true if unset
+	Blur       float64 `json:"BLUR"`
+	Sharpen    float64 `json:"SHARPEN"`
+	Grayscale  bool    `json:"GRAYSCALE"`
+	Brightness float64 `json:"BRIGHTNESS"`
+	Contrast   float64 `json:"CONTRAST"`
+	Saturation float64 `json:"SATURATION"`
+	Tint       string  `json:"TINT"`
+	Watermark  string  `json:"WATERMARK"` // name in WATERMARKS, used unless site or rule has one
+}
+
+var colorRegexp = regexp.MustCompile(`^#?([0-9a-fA-F]{3}|[0-9a-fA-F]{6}|[0-9a-fA-F]{8})$`)
+
+func validatePresets(presets map[string]Preset) []error {
+	var problems []error
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		preset := presets[name]
+		prefix := "PRESETS." + name
+		if !siteNameRegexp.MatchString(name) {
+			problems = append(problems, fmt.Errorf("%s: name can only contain letters, digits, '.', '-' and '_'", prefix))
+		}
+		if preset.Width < 0 || preset.Height < 0 {
+			problems = append(problems, fmt.Errorf("%s: WIDTH and HEIGHT can't be negative", prefix))
+		}
+		if preset.Fit != "" && !contains(Fits, preset.Fit) {
+			problems = append(problems, fmt.Errorf("%s.FIT: unknown value %q, supported values are %s", prefix, preset.Fit, strings.Join(Fits, ", ")))
+		}
+		if preset.Background != "" && !colorRegexp.MatchString(preset.Background) {
+			problems = append(problems, fmt.Errorf("%s.BACKGROUND: bad color %q, expected hex like fff, ffffff or ffffff80", prefix, preset.Background))
+		}
+		if preset.Gravity != "" && !contains(Gravities, preset.Gravity) {
+			problems = append(problems, fmt.Errorf("%s.GRAVITY: unknown value %q, supported values are %s", prefix, preset.Gravity, strings.Join(Gravities, ", ")))
+		}
+		if preset.Gravity != "" && preset.Focus != "" {
+			problems = append(problems, fmt.Errorf("%s: GRAVITY can't be used with FOCUS", prefix))
+		}
+		if preset.Focus != "" && !validFocus(preset.Focus) {
+			problems = append(problems, fmt.Errorf("%s.FOCUS: bad focal point %q, expected x,y between 0 and 1 like 0.5,0.3", prefix, preset.Focus))
+		}
+		if preset.Rotate%90 != 0 {
+			problems = append(problems, fmt.Errorf("%s.ROTATE: expected a multiple of 90, got %d", prefix, preset.Rotate))
+		}
+		if preset.Blur < 0 || preset.Sharpen < 0 || preset.Brightness < 0 || preset.Contrast < 0 || preset.Saturation < 0 {
+			problems = append(problems, fmt.Errorf("%s: BLUR, SHARPEN, BRIGHTNESS, CONTRAST and SATURATION can't be negative", prefix))
+		}
+		if preset.Tint != "" && !colorRegexp.MatchString(preset.Tint) {
+			problems = append(problems, fmt.Errorf("%s.TINT: bad color %q, expected hex like fff or ffffff", prefix, preset.Tint))
+		}
+		if preset.Quality < 0 || preset.Quality > 100 {
+			problems = append(problems, fmt.Errorf("%s.QUALITY: must be 0 (use QUALITY) or between 1 and 100, got %d", prefix, preset.Quality))
+		}
+	}
+	return problems
+}
+
+func validFocus(s string) bool {
+	x, y, found := strings.Cut(s, ",")
+	fx, errX := strconv.ParseFloat(x, 64)
+	fy, errY := strconv.ParseFloat(y, 64)
+	return found && errX == nil && errY == nil && fx >= 0 && fx <= 1 && fy >= 0 && fy <= 1
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
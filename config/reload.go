@@ -0,0 +1,111 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// reloadLock is held for writing while Config and sites are swapped, and for reading while a site is copied
+// out of them. Requests work on their copy, so they see either the old or the new config, never a mix of
+// both, and a reload never waits for requests being served.
+var reloadLock sync.RWMutex
+
+// ReloadConfig re-reads config from ConfigPath, env and flags. If the new config has any problem,
+// the current one is kept active and an error is returned.
+func ReloadConfig() error {
+	c, resolved, problems := loadConfig()
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			log.Errorf("Invalid config: %v", problem)
+		}
+		return fmt.Errorf("found %d problem(s) in config %s, keeping current config", len(problems), ConfigPath)
+	}
+
+	reloadLock.Lock()
+	if c.Host != Config.Host || c.Port != Config.Port {
+		log.Warn("HOST and PORT can't be changed by reloading, restart to listen on the new address.")
+	}
+	changes := diffConfig(&Config, &c)
+	Config = c
+	sites = resolved
+	switchProxyMode()
+	reloadLock.Unlock()
+	// new sites and paths are served right away, their directories are created like at startup
+	PrepareDirs()
+
+	if len(changes) == 0 {
+		log.Info("Config reloaded, nothing changed.")
+		return nil
+	}
+	for _, change := range changes {
+		log.Infof("Config reloaded, %s", change)
+	}
+	return nil
+}
+
+// secretKeys are not printed when they change, SITES may hold SIGNING_KEYS of each site
+var secretKeys = map[string]bool{"SIGNING_KEYS": true, "SITES": true}
+
+// diffConfig lists changed keys as "QUALITY: 80 -> 70"
+func diffConfig(current, next *jsonFile) []string {
+	var (
+		changes []string
+		ov      = reflect.ValueOf(current).Elem()
+		nv      = reflect.ValueOf(next).Elem()
+		t       = ov.Type()
+	)
+	for i := 0; i < t.NumField(); i++ {
+		key := jsonKey(t.Field(i))
+		if key == "" {
+			continue
+		}
+		o, n := ov.Field(i).Interface(), nv.Field(i).Interface()
+		if reflect.DeepEqual(o, n) {
+			continue
+		}
+		if secretKeys[key] {
+			changes = append(changes, key+": changed")
+			continue
+		}
+		if kind := ov.Field(i).Kind(); kind == reflect.Slice && ov.Field(i).Type().Elem().Kind() != reflect.String || kind == reflect.Map || kind == reflect.Struct {
+			o, _ = json.Marshal(o)
+			n, _ = json.Marshal(n)
+			o, n = string(o.([]byte)), string(n.([]byte))
+		}
+		changes = append(changes, fmt.Sprintf("%s: %v -> %v", key, o, n))
+	}
+	return changes
+}
+
+// WatchConfig polls ConfigPath and reloads config when its modification time or size changes.
+func WatchConfig(interval time.Duration) {
+	var last os.FileInfo
+	if info, err := os.Stat(ConfigPath); err == nil {
+		last = info
+	}
+	for range time.Tick(interval) {
+		info, err := os.Stat(ConfigPath)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) || last != nil {
+				log.Warnf("Can't watch config file: %v", err)
+			}
+			last = nil
+			continue
+		}
+		if last != nil && info.ModTime().Equal(last.ModTime()) && info.Size() == last.Size() {
+			continue
+		}
+		last = info
+		log.Infof("Config file %s changed, reloading...", ConfigPath)
+		if err := ReloadConfig(); err != nil {
+			log.Error(err)
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// OptimizedFormats are the formats images can be converted to
+var OptimizedFormats = []string{"webp", "avif", "jxl"}
+
+// OutputFormats can be asked with format query, original serves the source image
+var OutputFormats = []string{"webp", "avif", "jxl", "jpeg", "png", "original"}
+
+// Rule overrides settings for requests whose path matches it, rules are evaluated in order and the first match wins.
+// Fields left out keep the value of site.
+type Rule struct {
+	Name              string       `json:"NAME"`
+	Prefix            string       `json:"PREFIX"` // e.g. /avatars/
+	Glob              string       `json:"GLOB"`   // matched against the whole path, e.g. /products/*.png
+	Quality           int          `json:"QUALITY,string"`
+	Lossless          *bool        `json:"LOSSLESS"`
+	AutoLossless      *bool        `json:"AUTO_LOSSLESS"`
+	AllowedTypes      []string     `json:"ALLOWED_TYPES"`
+	Formats           []string     `json:"FORMATS"` // empty list serves original image without conversion
+	EnableExtraParams *bool        `json:"ENABLE_EXTRA_PARAMS"`
+	Watermark         *string      `json:"WATERMARK"` // "" removes watermark of site
+	Text              *TextOverlay `json:"TEXT"`      // {} removes text of site
+}
+
+func (r *Rule) match(reqPath string) bool {
+	if r.Prefix != "" && !strings.HasPrefix(reqPath, r.Prefix) {
+		return false
+	}
+	if r.Glob != "" {
+		matched, _ := path.Match(r.Glob, reqPath)
+		return matched
+	}
+	return true
+}
+
+func (r *Rule) label() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	return r.Prefix + r.Glob
+}
+
+// ApplyRule applies the first rule matching reqPath to site, reqPath must be cleaned already.
+func (s *Site) ApplyRule(reqPath string) {
+	for i := range s.Rules {
+		rule := &s.Rules[i]
+		if !rule.match(reqPath) {
+			continue
+		}
+		s.RuleName = rule.label()
+		if rule.Quality > 0 {
+			// rule is more specific than per format quality of site
+			s.Quality = rule.Quality
+			s.WebpQuality, s.AvifQuality, s.JxlQuality = 0, 0, 0
+		}
+		if rule.Lossless != nil {
+			s.Lossless = *rule.Lossless
+		}
+		if rule.AutoLossless != nil {
+			s.AutoLossless = *rule.AutoLossless
+		}
+		if rule.AllowedTypes != nil {
+			s.AllowedTypes = rule.AllowedTypes
+		}
+		if rule.Formats != nil {
+			s.Formats = rule.Formats
+		}
+		if rule.EnableExtraParams != nil {
+			s.EnableExtraParams = *rule.EnableExtraParams
+		}
+		if rule.Watermark != nil {
+			s.Watermark = *rule.Watermark
+		}
+		if rule.Text != nil {
+			s.Text = *rule.Text
+		}
+		return
+	}
+}
+
+// QualityOf returns quality of an optimized format, QUALITY is used if there is no quality for the format
+func (s *Site) QualityOf(format string) int {
+	switch {
+	case format == "webp" && s.WebpQuality > 0:
+		return s.WebpQuality
+	case format == "avif" && s.AvifQuality > 0:
+		return s.AvifQuality
+	case format == "jxl" && s.JxlQuality > 0:
+		return s.JxlQuality
+	default:
+		return s.Quality
+	}
+}
+
+// FormatEnabled tells if an optimized format can be generated for the request, webp is always enabled,
+// avif and jxl follow ENABLE_AVIF and ENABLE_JXL, unless a rule says otherwise.
+func (s *Site) FormatEnabled(format string) bool {
+	if s.Formats == nil {
+		return format == "webp" || format == "avif" && s.EnableAVIF || format == "jxl" && s.EnableJXL
+	}
+	for _, f := range s.Formats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// ConversionDisabled tells if original image should be served as is
+func (s *Site) ConversionDisabled() bool {
+	return s.Formats != nil && len(s.Formats) == 0
+}
+
+func validateRules(rules []Rule) []error {
+	var problems []error
+	for i, rule := range rules {
+		prefix := fmt.Sprintf("RULES[%d]", i)
+		if rule.Prefix == "" && rule.Glob == "" {
+			problems = append(problems, fmt.Errorf("%s: PREFIX or GLOB is required", prefix))
+		}
+		if rule.Prefix != "" && !strings.HasPrefix(rule.Prefix, "/") {
+			problems = append(problems, fmt.Errorf("%s.PREFIX: must start with /, got %q", prefix, rule.Prefix))
+		}
+		if _, err := path.Match(rule.Glob, ""); err != nil {
+			problems = append(problems, fmt.Errorf("%s.GLOB: bad pattern %q", prefix, rule.Glob))
+		}
+		if rule.Quality < 0 || rule.Quality > 100 {
+			problems = append(problems, fmt.Errorf("%s.QUALITY: must be 0 (use QUALITY) or between 1 and 100, got %d", prefix, rule.Quality))
+		}
+		if rule.Text != nil {
+			problems = append(problems, validateText(prefix+".TEXT", *rule.Text)...)
+		}
+		for _, format := range rule.Formats {
+			if !isOptimizedFormat(format) {
+				problems = append(problems, fmt.Errorf("%s.FORMATS: unknown format %q, supported formats are %s", prefix, format, strings.Join(OptimizedFormats, ", ")))
+			}
+		}
+	}
+	return problems
+}
+
+func isOptimizedFormat(format string) bool {
+	for _, f := range OptimizedFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
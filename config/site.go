@@ -0,0 +1,158 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// siteFile is an entry of SITES in config file, keys left out inherit the top level value
+type siteFile map[string]json.RawMessage
+
+// Site is the settings a request is served with, chosen by the Host header of request.
+// Top level config is the default site, which serves every host not listed in SITES.
+type Site struct {
+	jsonFile
+	Name      string   // used as sub directory of exhaust, metadata and remote-raw, empty for default site
+	Hosts     []string // host names or patterns like *.example.com
+	ProxyMode bool
+
+	// set by ApplyRule
+	RuleName string
+	Lossless bool
+	Formats  []string
+}
+
+// sites are resolved from Config.Sites every time config is loaded
+var sites []Site
+
+// processKeys can't be set per site, they are about the process rather than a site
+var processKeys = map[string]bool{"HOST": true, "PORT": true, "SITES": true}
+
+// SiteFor returns a copy of the site serving host, falls back to default site.
+func SiteFor(host string) Site {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	for _, site := range sites {
+		for _, pattern := range site.Hosts {
+			if matched, _ := path.Match(pattern, host); matched {
+				return site
+			}
+		}
+	}
+	return defaultSite()
+}
+
+// DefaultSite is the site built from top level config
+func DefaultSite() Site {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return defaultSite()
+}
+
+func defaultSite() Site {
+	c := Config
+	c.Sites = nil
+	return Site{jsonFile: c, ProxyMode: ProxyMode}
+}
+
+// AllSites returns default site followed by sites in SITES
+func AllSites() []Site {
+	reloadLock.RLock()
+	defer reloadLock.RUnlock()
+	return append([]Site{defaultSite()}, sites...)
+}
+
+// resolveSites decodes every SITES entry on top of a copy of c, so it inherits the top level values.
+func resolveSites(c *jsonFile) ([]Site, []error) {
+	var (
+		resolved []Site
+		problems []error
+		seen     = map[string]string{}
+	)
+	for i, raw := range c.Sites {
+		var (
+			site   = Site{jsonFile: *c}
+			prefix = fmt.Sprintf("SITES[%d].", i)
+			rest   = map[string]json.RawMessage{}
+		)
+		site.Sites = nil
+
+		keys := make([]string, 0, len(raw))
+		for key := range raw {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			value := raw[key]
+			switch {
+			case key == "NAME":
+				if err := json.Unmarshal(value, &site.Name); err != nil {
+					problems = append(problems, fmt.Errorf("%sNAME: expected a string, got %s", prefix, value))
+				}
+			case key == "HOSTS":
+				if err := json.Unmarshal(value, &site.Hosts); err != nil {
+					problems = append(problems, fmt.Errorf("%sHOSTS: expected a list of string, got %s", prefix, value))
+				}
+			case processKeys[key]:
+				problems = append(problems, fmt.Errorf("%s%s: can't be set per site", prefix, key))
+			default:
+				rest[key] = value
+			}
+		}
+		problems = append(problems, decodeFields(reflect.ValueOf(&site.jsonFile).Elem(), rest, prefix)...)
+
+		if len(site.Hosts) == 0 {
+			problems = append(problems, fmt.Errorf("%sHOSTS: at least one host is required", prefix))
+			continue
+		}
+		for j, host := range site.Hosts {
+			host = strings.ToLower(host)
+			site.Hosts[j] = host
+			if _, err := path.Match(host, ""); err != nil {
+				problems = append(problems, fmt.Errorf("%sHOSTS: bad pattern %q", prefix, host))
+			}
+			if other, ok := seen[host]; ok {
+				problems = append(problems, fmt.Errorf("%sHOSTS: %s is already served by %s", prefix, host, other))
+			}
+			seen[host] = strings.TrimSuffix(prefix, ".")
+		}
+		if site.Name == "" {
+			site.Name = strings.ReplaceAll(site.Hosts[0], "*", "_")
+		}
+		if !siteNameRegexp.MatchString(site.Name) {
+			problems = append(problems, fmt.Errorf("%sNAME: %q can only contain letters, digits, '.', '-' and '_'", prefix, site.Name))
+		}
+		if _, ok := rest["EXHAUST_PATH"]; !ok {
+			site.ExhaustPath = path.Join(c.ExhaustPath, site.Name)
+		}
+		if _, ok := rest["METADATA_PATH"]; !ok {
+			site.MetadataPath = path.Join(c.MetadataPath, site.Name)
+		}
+		if _, ok := rest["REMOTE_RAW_PATH"]; !ok {
+			site.RemoteRawPath = path.Join(c.RemoteRawPath, site.Name)
+		}
+		matched, _ := regexp.MatchString(`^https?://`, site.ImgPath)
+		site.ProxyMode = matched
+
+		for _, err := range validateSiteConfig(&site.jsonFile) {
+			problems = append(problems, fmt.Errorf("%s%w", prefix, err))
+		}
+		resolved = append(resolved, site)
+	}
+	if len(problems) > 0 {
+		return nil, problems
+	}
+	return resolved, nil
+}
+
+var siteNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_][a-zA-Z0-9._-]*$`)
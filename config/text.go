@@ -0,0 +1,43 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxTextLength limits text overlays, longer ones can't be read on an image anyway
+const MaxTextLength = 200
+
+// TextOverlay is text rendered on output images, set with TEXT of site or rule, or by signed text param
+type TextOverlay struct {
+	Text       string `json:"TEXT"`
+	Font       string `json:"FONT"`       // fontconfig name like "DejaVu Sans Bold", sans if empty
+	Size       int    `json:"SIZE"`       // in px, 24 if not set
+	Color      string `json:"COLOR"`      // hex, white if empty
+	Gravity    string `json:"GRAVITY"`    // where it's put, southwest if empty
+	Margin     int    `json:"MARGIN"`     // in px, from the edges it's put against
+	Background string `json:"BACKGROUND"` // hex color of a box behind text, e.g. 00000080, no box if empty
+}
+
+func validateText(prefix string, text TextOverlay) []error {
+	var problems []error
+	if len(text.Text) > MaxTextLength {
+		problems = append(problems, fmt.Errorf("%s.TEXT: can't be longer than %d bytes", prefix, MaxTextLength))
+	}
+	if text.Size < 0 || text.Size > 1000 {
+		problems = append(problems, fmt.Errorf("%s.SIZE: must be between 1 and 1000, got %d", prefix, text.Size))
+	}
+	if text.Margin < 0 {
+		problems = append(problems, fmt.Errorf("%s.MARGIN: can't be negative, got %d", prefix, text.Margin))
+	}
+	if text.Color != "" && !colorRegexp.MatchString(text.Color) {
+		problems = append(problems, fmt.Errorf("%s.COLOR: bad color %q, expected hex like fff, ffffff or ffffff80", prefix, text.Color))
+	}
+	if text.Background != "" && !colorRegexp.MatchString(text.Background) {
+		problems = append(problems, fmt.Errorf("%s.BACKGROUND: bad color %q, expected hex like fff, ffffff or ffffff80", prefix, text.Background))
+	}
+	if text.Gravity != "" && !contains(CompassGravities, text.Gravity) {
+		problems = append(problems, fmt.Errorf("%s.GRAVITY: unknown value %q, supported values are %s", prefix, text.Gravity, strings.Join(CompassGravities, ", ")))
+	}
+	return problems
+}
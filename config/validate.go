@@ -0,0 +1,299 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var schemeRegexp = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://`)
+
+// decodeStrict decodes a config file into c, unlike json.Decoder it doesn't stop at the first problem,
+// unknown keys and type mismatches of every key are reported together.
+func decodeStrict(data []byte, c *jsonFile) []error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return []error{fmt.Errorf("invalid JSON: %w", err)}
+	}
+	return decodeFields(reflect.ValueOf(c).Elem(), raw, "")
+}
+
+// decodeFields decodes keys of a JSON object into struct v, prefix is prepended to keys in problems, e.g. RULES[0].
+func decodeFields(v reflect.Value, raw map[string]json.RawMessage, prefix string) []error {
+	var (
+		problems []error
+		t        = v.Type()
+		fields   = map[string]int{}
+		keys     = make([]string, 0, len(raw))
+	)
+	for i := 0; i < t.NumField(); i++ {
+		if key := jsonKey(t.Field(i)); key != "" {
+			fields[key] = i
+		}
+	}
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		i, ok := fields[key]
+		if !ok {
+			problems = append(problems, fmt.Errorf("%s%s: unknown key", prefix, key))
+			continue
+		}
+		stringOpt := strings.Contains(t.Field(i).Tag.Get("json"), ",string")
+		problems = append(problems, decodeValue(v.Field(i), raw[key], stringOpt, prefix+key)...)
+	}
+	return problems
+}
+
+// decodeValue decodes raw into v, objects nested in v are decoded strictly as well.
+func decodeValue(v reflect.Value, raw json.RawMessage, stringOpt bool, name string) []error {
+	t := v.Type()
+	switch {
+	case t.Kind() == reflect.Struct:
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return []error{fmt.Errorf("%s: expected an object, got %s", name, raw)}
+		}
+		return decodeFields(v, obj, name+".")
+	case t.Kind() == reflect.Pointer && t.Elem().Kind() == reflect.Struct:
+		// set objects are told apart from left out ones by pointer, e.g. to unset a value in a rule
+		v.Set(reflect.New(t.Elem()))
+		return decodeValue(v.Elem(), raw, false, name)
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Struct:
+		var list []json.RawMessage
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return []error{fmt.Errorf("%s: expected a list of object, got %s", name, raw)}
+		}
+		var problems []error
+		v.Set(reflect.MakeSlice(t, len(list), len(list)))
+		for i, item := range list {
+			problems = append(problems, decodeValue(v.Index(i), item, false, fmt.Sprintf("%s[%d]", name, i))...)
+		}
+		return problems
+	case t.Kind() == reflect.Map && t.Key().Kind() == reflect.String && t.Elem().Kind() == reflect.Struct:
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &obj); err != nil {
+			return []error{fmt.Errorf("%s: expected an object, got %s", name, raw)}
+		}
+		var (
+			problems []error
+			keys     = make([]string, 0, len(obj))
+		)
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		v.Set(reflect.MakeMapWithSize(t, len(obj)))
+		for _, key := range keys {
+			elem := reflect.New(t.Elem()).Elem()
+			problems = append(problems, decodeValue(elem, obj[key], false, name+"."+key)...)
+			v.SetMapIndex(reflect.ValueOf(key).Convert(t.Key()), elem)
+		}
+		return problems
+	}
+
+	if err := decodeScalar(v, raw, stringOpt); err != nil {
+		return []error{fmt.Errorf("%s: %w", name, err)}
+	}
+	return nil
+}
+
+func decodeScalar(field reflect.Value, raw json.RawMessage, stringOpt bool) error {
+	if stringOpt {
+		// QUALITY can be written as "80" or 80
+		s := string(raw)
+		_ = json.Unmarshal(raw, &s)
+		if err := setField(field, s); err != nil {
+			return fmt.Errorf("expected a %s, got %s", typeName(field.Type()), raw)
+		}
+		return nil
+	}
+
+	err := json.Unmarshal(raw, field.Addr().Interface())
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return fmt.Errorf("expected a %s, got %s", typeName(field.Type()), raw)
+	}
+	return err
+}
+
+func typeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Int, reflect.Float64:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice:
+		return "list of " + typeName(t.Elem())
+	case reflect.Map, reflect.Struct:
+		return "object"
+	case reflect.Pointer:
+		return typeName(t.Elem())
+	default:
+		return t.String()
+	}
+}
+
+// validateConfig checks values that are well-typed but can't work, every problem is returned.
+func validateConfig(c *jsonFile) []error {
+	var problems []error
+
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		problems = append(problems, fmt.Errorf("PORT: must be a number between 1 and 65535, got %q", c.Port))
+	}
+	return append(problems, validateSiteConfig(c)...)
+}
+
+// validateSiteConfig checks the keys a site can override
+func validateSiteConfig(c *jsonFile) []error {
+	var problems []error
+
+	if c.Quality < 1 || c.Quality > 100 {
+		problems = append(problems, fmt.Errorf("QUALITY: must be between 1 and 100, got %d", c.Quality))
+	}
+	if c.WebpQuality < 0 || c.WebpQuality > 100 {
+		problems = append(problems, fmt.Errorf("WEBP_QUALITY: must be 0 (use QUALITY) or between 1 and 100, got %d", c.WebpQuality))
+	}
+	if c.AvifQuality < 0 || c.AvifQuality > 100 {
+		problems = append(problems, fmt.Errorf("AVIF_QUALITY: must be 0 (use QUALITY) or between 1 and 100, got %d", c.AvifQuality))
+	}
+	if c.JxlQuality < 0 || c.JxlQuality > 100 {
+		problems = append(problems, fmt.Errorf("JXL_QUALITY: must be 0 (use QUALITY) or between 1 and 100, got %d", c.JxlQuality))
+	}
+	if c.WebpMethod < 0 || c.WebpMethod > 6 {
+		problems = append(problems, fmt.Errorf("WEBP_METHOD: must be between 0 and 6, got %d", c.WebpMethod))
+	}
+	if c.AvifEffort < 0 || c.AvifEffort > 9 {
+		problems = append(problems, fmt.Errorf("AVIF_EFFORT: must be between 0 and 9, got %d", c.AvifEffort))
+	}
+	if c.SaveDataQuality < 0 || c.SaveDataQuality > 100 {
+		problems = append(problems, fmt.Errorf("SAVE_DATA_QUALITY: must be 0 (ignore Save-Data) or between 1 and 100, got %d", c.SaveDataQuality))
+	}
+	if c.SaveDataMaxWidth < 0 || c.SaveDataMaxHeight < 0 {
+		problems = append(problems, errors.New("SAVE_DATA_MAX_WIDTH, SAVE_DATA_MAX_HEIGHT: can't be negative"))
+	}
+	for _, size := range append(append([]int{}, c.AllowedWidths...), c.AllowedHeights...) {
+		if size < 1 {
+			problems = append(problems, fmt.Errorf("ALLOWED_WIDTHS, ALLOWED_HEIGHTS: sizes must be positive, got %d", size))
+			break
+		}
+	}
+	if c.SizeStep < 0 || c.MinSize < 0 || c.MaxSize < 0 {
+		problems = append(problems, errors.New("SIZE_STEP, MIN_SIZE, MAX_SIZE: can't be negative"))
+	}
+	if c.MaxSize > 0 && c.MinSize > c.MaxSize {
+		problems = append(problems, fmt.Errorf("MIN_SIZE: must not be larger than MAX_SIZE %d, got %d", c.MaxSize, c.MinSize))
+	}
+	if c.SizePolicy != "" && c.SizePolicy != SizePolicyReject && c.SizePolicy != SizePolicySnap {
+		problems = append(problems, fmt.Errorf("SIZE_POLICY: must be %s or %s, got %q", SizePolicyReject, SizePolicySnap, c.SizePolicy))
+	}
+	if c.UnsignedPolicy != "" && c.UnsignedPolicy != UnsignedPolicyOriginal && c.UnsignedPolicy != UnsignedPolicyForbid {
+		problems = append(problems, fmt.Errorf("UNSIGNED_POLICY: must be %s or %s, got %q", UnsignedPolicyOriginal, UnsignedPolicyForbid, c.UnsignedPolicy))
+	}
+	for _, key := range c.SigningKeys {
+		if len(key) < 16 {
+			problems = append(problems, errors.New("SIGNING_KEYS: keys must be at least 16 characters long"))
+			break
+		}
+	}
+	if c.MaxDpr < 1 || c.MaxDpr > 10 {
+		problems = append(problems, fmt.Errorf("MAX_DPR: must be between 1 and 10, got %g", c.MaxDpr))
+	}
+	if c.MaxBlur < 0 || c.MaxSharpen < 0 || c.MaxAdjustment < 0 {
+		problems = append(problems, errors.New("MAX_BLUR, MAX_SHARPEN, MAX_ADJUSTMENT: can't be negative"))
+	}
+	// factors go from 1/MAX_ADJUSTMENT to MAX_ADJUSTMENT
+	if c.MaxAdjustment > 0 && c.MaxAdjustment < 1 {
+		problems = append(problems, fmt.Errorf("MAX_ADJUSTMENT: must be 0 or at least 1, got %g", c.MaxAdjustment))
+	}
+	if c.JxlEffort < 1 || c.JxlEffort > 9 {
+		problems = append(problems, fmt.Errorf("JXL_EFFORT: must be between 1 and 9, got %d", c.JxlEffort))
+	}
+	if len(c.AllowedTypes) == 0 {
+		problems = append(problems, errors.New("ALLOWED_TYPES: at least one type is required"))
+	}
+	if err := checkImgPath(c.ImgPath); err != nil {
+		problems = append(problems, fmt.Errorf("IMG_PATH: %w", err))
+	}
+	if err := checkWritable(c.ExhaustPath); err != nil {
+		problems = append(problems, fmt.Errorf("EXHAUST_PATH: %w", err))
+	}
+	// empty ones default to EXHAUST_PATH
+	if err := checkWritable(c.MetadataPath); err != nil && c.MetadataPath != "" {
+		problems = append(problems, fmt.Errorf("METADATA_PATH: %w", err))
+	}
+	if err := checkWritable(c.RemoteRawPath); err != nil && c.RemoteRawPath != "" {
+		problems = append(problems, fmt.Errorf("REMOTE_RAW_PATH: %w", err))
+	}
+	problems = append(problems, validatePresets(c.Presets)...)
+	problems = append(problems, validateWatermarks(c)...)
+	problems = append(problems, validateText("TEXT", c.Text)...)
+	return append(problems, validateRules(c.Rules)...)
+}
+
+// checkImgPath accepts an existing local directory or an http(s) origin for proxy mode
+func checkImgPath(p string) error {
+	if p == "" {
+		return errors.New("must not be empty")
+	}
+	if schemeRegexp.MatchString(p) {
+		u, err := url.Parse(p)
+		if err != nil {
+			return fmt.Errorf("malformed proxy URL: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("proxy URL scheme must be http or https, got %q", u.Scheme)
+		}
+		if u.Host == "" {
+			return fmt.Errorf("proxy URL %q has no host", p)
+		}
+		return nil
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", p)
+	}
+	return nil
+}
+
+// checkWritable makes sure dir, or its nearest existing parent if dir is not created yet, is writable.
+func checkWritable(dir string) error {
+	if dir == "" {
+		return errors.New("must not be empty")
+	}
+	for p := filepath.Clean(dir); ; p = filepath.Dir(p) {
+		info, err := os.Stat(p)
+		if os.IsNotExist(err) && filepath.Dir(p) != p {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", p)
+		}
+		f, err := os.CreateTemp(p, ".webp-server-check-*")
+		if err != nil {
+			return fmt.Errorf("%s is not writable: %w", p, err)
+		}
+		_ = f.Close()
+		return os.Remove(f.Name())
+	}
+}
@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Watermark is an image stamped on output images, selected by name with WATERMARK of site, rule or preset.
+type Watermark struct {
+	Path    string  `json:"PATH"`    // PNG with alpha works best
+	Gravity string  `json:"GRAVITY"` // where it's put, southeast if empty
+	Margin  int     `json:"MARGIN"`  // in px, from the edges it's put against
+	Opacity float64 `json:"OPACITY"` // 0-1, 1 if not set
+	Scale   float64 `json:"SCALE"`   // width relative to output width, 0 keeps its own size
+}
+
+// validateWatermarks checks WATERMARKS and every WATERMARK referring to them
+func validateWatermarks(c *jsonFile) []error {
+	var problems []error
+	names := make([]string, 0, len(c.Watermarks))
+	for name := range c.Watermarks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		watermark := c.Watermarks[name]
+		prefix := "WATERMARKS." + name
+		if info, err := os.Stat(watermark.Path); err != nil {
+			problems = append(problems, fmt.Errorf("%s.PATH: %w", prefix, err))
+		} else if info.IsDir() {
+			problems = append(problems, fmt.Errorf("%s.PATH: %s is a directory", prefix, watermark.Path))
+		}
+		if watermark.Gravity != "" && !contains(CompassGravities, watermark.Gravity) {
+			problems = append(problems, fmt.Errorf("%s.GRAVITY: unknown value %q, supported values are %s", prefix, watermark.Gravity, strings.Join(CompassGravities, ", ")))
+		}
+		if watermark.Margin < 0 {
+			problems = append(problems, fmt.Errorf("%s.MARGIN: can't be negative, got %d", prefix, watermark.Margin))
+		}
+		if watermark.Opacity < 0 || watermark.Opacity > 1 {
+			problems = append(problems, fmt.Errorf("%s.OPACITY: must be between 0 and 1, got %g", prefix, watermark.Opacity))
+		}
+		if watermark.Scale < 0 || watermark.Scale > 1 {
+			problems = append(problems, fmt.Errorf("%s.SCALE: must be between 0 and 1, got %g", prefix, watermark.Scale))
+		}
+	}
+
+	checkName := func(key, name string) {
+		if _, ok := c.Watermarks[name]; name != "" && !ok {
+			problems = append(problems, fmt.Errorf("%s: unknown watermark %q", key, name))
+		}
+	}
+	checkName("WATERMARK", c.Watermark)
+	for i, rule := range c.Rules {
+		if rule.Watermark != nil {
+			checkName(fmt.Sprintf("RULES[%d].WATERMARK", i), *rule.Watermark)
+		}
+	}
+	presetNames := make([]string, 0, len(c.Presets))
+	for name := range c.Presets {
+		presetNames = append(presetNames, name)
+	}
+	sort.Strings(presetNames)
+	for _, name := range presetNames {
+		checkName("PRESETS."+name+".WATERMARK", c.Presets[name].Watermark)
+	}
+	return problems
+}
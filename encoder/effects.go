@@ -0,0 +1,82 @@
+package encoder
+
+import (
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// applyEffects runs effects of params on resized img, in this order: blur, sharpen,
+// brightness, contrast and saturation, grayscale, then tint.
+func applyEffects(img *vips.ImageRef, extraParams config.ExtraParams) error {
+	if extraParams.Blur > 0 {
+		if err := img.GaussianBlur(extraParams.Blur); err != nil {
+			return err
+		}
+	}
+	if extraParams.Sharpen > 0 {
+		// flat and jaggy settings are the defaults of vips_sharpen
+		if err := img.Sharpen(extraParams.Sharpen, 2, 3); err != nil {
+			return err
+		}
+	}
+	if extraParams.Brightness > 0 || extraParams.Contrast > 0 || extraParams.Saturation > 0 {
+		if err := adjustColors(img, extraParams); err != nil {
+			return err
+		}
+	}
+	if extraParams.Grayscale || extraParams.Tint != "" {
+		if err := img.ToColorSpace(vips.InterpretationBW); err != nil {
+			return err
+		}
+	}
+	if extraParams.Tint != "" {
+		return tint(img, extraParams.Tint)
+	}
+	return nil
+}
+
+// adjustColors scales lightness and chroma in LCh, so it works the same whatever depth and color space img has
+func adjustColors(img *vips.ImageRef, extraParams config.ExtraParams) error {
+	brightness, contrast, saturation := factor(extraParams.Brightness), factor(extraParams.Contrast), factor(extraParams.Saturation)
+	colorSpace := img.ColorSpace()
+	if colorSpace == vips.InterpretationRGB {
+		colorSpace = vips.InterpretationSRGB
+	}
+	if err := img.ToColorSpace(vips.InterpretationLCH); err != nil {
+		return err
+	}
+	// contrast spreads lightness away from the middle, 50 of 0-100
+	multiplications := []float64{brightness * contrast, saturation, 1}
+	additions := []float64{50 * (1 - contrast), 0, 0}
+	if img.HasAlpha() {
+		multiplications, additions = append(multiplications, 1), append(additions, 0)
+	}
+	if err := img.Linear(multiplications, additions); err != nil {
+		return err
+	}
+	return img.ToColorSpace(colorSpace)
+}
+
+// tint turns grey img into shades of color, from black to color
+func tint(img *vips.ImageRef, color string) error {
+	rgb, _ := helper.ParseColor(color)
+	if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return err
+	}
+	multiplications := []float64{float64(rgb[0]) / 255, float64(rgb[1]) / 255, float64(rgb[2]) / 255}
+	additions := []float64{0, 0, 0}
+	if img.HasAlpha() {
+		multiplications, additions = append(multiplications, 1), append(additions, 0)
+	}
+	return img.Linear(multiplications, additions)
+}
+
+// factor is 1 for factors not given
+func factor(f float64) float64 {
+	if f == 0 {
+		return 1
+	}
+	return f
+}
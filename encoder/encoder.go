@@ -14,6 +14,9 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+// maxCoord is the largest size libvips handles, used for a side that is not constrained
+const maxCoord = 10000000
+
 var (
 	boolFalse   vips.BoolParameter
 	intMinusOne vips.IntParameter
@@ -31,7 +34,7 @@ func init() {
 func resizeImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
 	imgHeightWidthRatio := float32(img.Metadata().Height) / float32(img.Metadata().Width)
 	if extraParams.Width > 0 && extraParams.Height > 0 {
-		err := img.Thumbnail(extraParams.Width, extraParams.Height, vips.InterestingAttention)
+		err := fitImage(img, extraParams)
 		if err != nil {
 			return err
 		}
@@ -46,17 +49,49 @@ func resizeImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
 			return err
 		}
 	}
+
+	// cap of Save-Data, only ever downscales
+	if extraParams.MaxWidth > 0 && img.Width() > extraParams.MaxWidth || extraParams.MaxHeight > 0 && img.PageHeight() > extraParams.MaxHeight {
+		maxWidth, maxHeight := extraParams.MaxWidth, extraParams.MaxHeight
+		if maxWidth == 0 {
+			maxWidth = maxCoord
+		}
+		if maxHeight == 0 {
+			maxHeight = maxCoord
+		}
+		return img.ThumbnailWithSize(maxWidth, maxHeight, vips.InterestingNone, vips.SizeDown)
+	}
 	return nil
 }
 
-func ConvertFilter(raw, avifPath, webpPath string, extraParams config.ExtraParams, c chan int) {
+// qualityOf is quality of format, quality of params such as Save-Data's wins over site's
+func qualityOf(format string, extraParams config.ExtraParams, site *config.Site) int {
+	if extraParams.Quality > 0 {
+		return extraParams.Quality
+	}
+	return site.QualityOf(format)
+}
+
+func ConvertFilter(raw, avifPath, webpPath, jxlPath string, extraParams config.ExtraParams, site *config.Site, c chan int) {
 	// all absolute paths
 
 	var wg sync.WaitGroup
-	wg.Add(2)
-	if !helper.ImageExists(avifPath) && config.Config.EnableAVIF {
+	wg.Add(3)
+	if !helper.ImageExists(avifPath) && site.FormatEnabled("avif") {
+		go func() {
+			err := convertImage(raw, avifPath, "avif", extraParams, site)
+			if err != nil {
+				log.Errorln(err)
+			}
+			defer wg.Done()
+		}()
+	} else {
+		wg.Done()
+	}
+
+	if !helper.ImageExists(webpPath) && site.FormatEnabled("webp") {
 		go func() {
-			err := convertImage(raw, avifPath, "avif", extraParams)
+			err := convertImage(raw, webpPath, "webp", extraParams, site)
 			if err != nil {
 				log.Errorln(err)
 			}
@@ -66,9 +101,9 @@ func ConvertFilter(raw, avifPath, webpPath string, extraParams config.ExtraParam
 		wg.Done()
 	}
 
-	if !helper.ImageExists(webpPath) {
+	if !helper.ImageExists(jxlPath) && site.FormatEnabled("jxl") {
 		go func() {
-			err := convertImage(raw, webpPath, "webp", extraParams)
+			err := convertImage(raw, jxlPath, "jxl", extraParams, site)
 			if err != nil {
 				log.Errorln(err)
 			}
@@ -84,18 +119,79 @@ func ConvertFilter(raw, avifPath, webpPath string, extraParams config.ExtraParam
 	}
 }
 
-func ResizeItself(raw, dest string, extraParams config.ExtraParams) {
+// ConvertTo converts raw to a single format, used when a format is asked explicitly instead of negotiated
+func ConvertTo(raw, optimized, imageType string, extraParams config.ExtraParams, site *config.Site) error {
+	if helper.ImageExists(optimized) {
+		return nil
+	}
+	return convertImage(raw, optimized, imageType, extraParams, site)
+}
+
+// ResizeItself applies params to raw and writes it in its own format to dest, which is left untouched
+// if any step fails, so a watermark or text is never missing from it
+func ResizeItself(raw, dest string, extraParams config.ExtraParams, site *config.Site) error {
 	log.Infof("Resize %s itself to %s", raw, dest)
-	img, _ := vips.LoadImageFromFile(raw, &vips.ImportParams{
+	img, err := vips.LoadImageFromFile(raw, &vips.ImportParams{
 		FailOnError: boolFalse,
 	})
-	_ = resizeImage(img, extraParams)
-	buf, _, _ := img.ExportNative()
-	_ = os.WriteFile(dest, buf, 0600)
-	img.Close()
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	err = orientImage(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = resizeImage(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = applyEffects(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = applyWatermark(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = applyText(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	// lossy formats use quality of params, like Save-Data's, or of site
+	var buf []byte
+	switch img.Format() {
+	case vips.ImageTypeJPEG:
+		ep := vips.NewJpegExportParams()
+		ep.Quality = qualityOf("jpeg", extraParams, site)
+		buf, _, err = img.ExportJpeg(ep)
+	case vips.ImageTypeWEBP:
+		ep := vips.NewWebpExportParams()
+		ep.Quality = qualityOf("webp", extraParams, site)
+		buf, _, err = img.ExportWebp(ep)
+	case vips.ImageTypeAVIF:
+		ep := vips.NewAvifExportParams()
+		ep.Quality = qualityOf("avif", extraParams, site)
+		buf, _, err = img.ExportAvif(ep)
+	default:
+		buf, _, err = img.ExportNative()
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(path.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(dest, buf, 0600)
 }
 
-func convertImage(raw, optimized, imageType string, extraParams config.ExtraParams) error {
+func convertImage(raw, optimized, imageType string, extraParams config.ExtraParams, site *config.Site) error {
 	// we need to create dir first
 	var err = os.MkdirAll(path.Dir(optimized), 0755)
 	if err != nil {
@@ -104,16 +200,20 @@ func convertImage(raw, optimized, imageType string, extraParams config.ExtraPara
 
 	switch imageType {
 	case "webp":
-		err = webpEncoder(raw, optimized, extraParams)
+		err = webpEncoder(raw, optimized, extraParams, site)
 	case "avif":
-		err = avifEncoder(raw, optimized, extraParams)
+		err = avifEncoder(raw, optimized, extraParams, site)
+	case "jxl":
+		err = jxlEncoder(raw, optimized, extraParams, site)
+	case "jpeg", "png":
+		err = legacyEncoder(raw, optimized, imageType, extraParams, site)
 	}
 	return err
 }
 
 func imageIgnore(imageFormat vips.ImageType) bool {
-	// Ignore Unknown, WebP, AVIF
-	ignoreList := []vips.ImageType{vips.ImageTypeUnknown, vips.ImageTypeWEBP, vips.ImageTypeAVIF}
+	// Ignore Unknown, WebP, AVIF, JXL
+	ignoreList := []vips.ImageType{vips.ImageTypeUnknown, vips.ImageTypeWEBP, vips.ImageTypeAVIF, vips.ImageTypeJXL}
 	for _, ignore := range ignoreList {
 		if imageFormat == ignore {
 			// Return err to render original image
@@ -123,11 +223,11 @@ func imageIgnore(imageFormat vips.ImageType) bool {
 	return false
 }
 
-func avifEncoder(p1, p2 string, extraParams config.ExtraParams) error {
+func avifEncoder(p1, p2 string, extraParams config.ExtraParams, site *config.Site) error {
 	// if convert fails, return error; success nil
 	var (
 		buf     []byte
-		quality = config.Config.Quality
+		quality = qualityOf("avif", extraParams, site)
 	)
 	img, err := vips.LoadImageFromFile(p1, &vips.ImportParams{
 		FailOnError: boolFalse,
@@ -135,40 +235,68 @@ func avifEncoder(p1, p2 string, extraParams config.ExtraParams) error {
 	if err != nil {
 		return err
 	}
+	defer img.Close()
 
 	if imageIgnore(img.Format()) {
 		return errors.New("encoder: ignore image type")
 	}
 
-	if config.Config.EnableExtraParams {
-		err = resizeImage(img, extraParams)
-		if err != nil {
-			return err
-		}
+	err = orientImage(img, extraParams)
+	if err != nil {
+		return err
 	}
 
-	// AVIF has a maximum resolution of 65536 x 65536 pixels.
-	if img.Metadata().Width > config.AvifMax || img.Metadata().Height > config.AvifMax {
-		return errors.New("AVIF: image too large")
+	err = resizeImage(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = applyEffects(img, extraParams)
+	if err != nil {
+		return err
 	}
 
-	err = img.AutoRotate()
+	err = applyWatermark(img, extraParams)
 	if err != nil {
 		return err
 	}
 
-	// If quality >= 100, we use lossless mode
-	if quality >= 100 {
+	err = applyText(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	// AVIF has a maximum resolution of 65536 x 65536 pixels.
+	if img.Metadata().Width > config.AvifMax || img.Metadata().Height > config.AvifMax {
+		return errors.New("AVIF: image too large")
+	}
+
+	// If quality >= 100 or a rule asks for it, we use lossless mode
+	if quality >= 100 || site.Lossless {
 		buf, _, err = img.ExportAvif(&vips.AvifExportParams{
 			Lossless:      true,
 			StripMetadata: true,
+			Effort:        site.AvifEffort,
 		})
 	} else {
 		buf, _, err = img.ExportAvif(&vips.AvifExportParams{
 			Quality:       quality,
 			Lossless:      false,
 			StripMetadata: true,
+			Effort:        site.AvifEffort,
 		})
+		// flat graphics are often smaller in lossless mode, keep the smaller one
+		if err == nil && site.AutoLossless && looksLikeGraphic(img) {
+			losslessBuf, _, losslessErr := img.ExportAvif(&vips.AvifExportParams{
+				Lossless:      true,
+				StripMetadata: true,
+				Effort:        site.AvifEffort,
+			})
+			if losslessErr == nil && len(losslessBuf) < len(buf) {
+				log.Infof("Lossless AVIF of %s is smaller, %d->%d bytes", p1, len(buf), len(losslessBuf))
+				buf = losslessBuf
+			}
+		}
 	}
 
 	if err != nil {
@@ -180,17 +308,16 @@ func avifEncoder(p1, p2 string, extraParams config.ExtraParams) error {
 		log.Error(err)
 		return err
 	}
-	img.Close()
 
 	convertLog("AVIF", p1, p2, quality)
 	return nil
 }
 
-func webpEncoder(p1, p2 string, extraParams config.ExtraParams) error {
+func webpEncoder(p1, p2 string, extraParams config.ExtraParams, site *config.Site) error {
 	// if convert fails, return error; success nil
 	var (
 		buf     []byte
-		quality = config.Config.Quality
+		quality = qualityOf("webp", extraParams, site)
 	)
 
 	img, err := vips.LoadImageFromFile(p1, &vips.ImportParams{
@@ -200,46 +327,63 @@ func webpEncoder(p1, p2 string, extraParams config.ExtraParams) error {
 	if err != nil {
 		return err
 	}
+	defer img.Close()
 
 	if imageIgnore(img.Format()) {
 		return errors.New("encoder: ignore image type")
 	}
 
-	if config.Config.EnableExtraParams {
-		err = resizeImage(img, extraParams)
-		if err != nil {
-			return err
-		}
+	err = orientImage(img, extraParams)
+	if err != nil {
+		return err
 	}
 
-	// The maximum pixel dimensions of a WebP image is 16383 x 16383.
-	if (img.Metadata().Width > config.WebpMax || img.Metadata().Height > config.WebpMax) && img.Format() != vips.ImageTypeGIF {
-		return errors.New("WebP: image too large")
+	err = resizeImage(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = applyEffects(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = applyWatermark(img, extraParams)
+	if err != nil {
+		return err
 	}
 
-	err = img.AutoRotate()
+	err = applyText(img, extraParams)
 	if err != nil {
 		return err
 	}
 
-	// If quality >= 100, we use lossless mode
-	if quality >= 100 {
+	// The maximum pixel dimensions of a WebP image is 16383 x 16383.
+	if (img.Metadata().Width > config.WebpMax || img.Metadata().Height > config.WebpMax) && img.Format() != vips.ImageTypeGIF {
+		return errors.New("WebP: image too large")
+	}
+
+	// If quality >= 100 or a rule asks for it, we use lossless mode
+	if quality >= 100 || site.Lossless {
 		// Lossless mode will not encounter problems as below, because in libvips as code below
 		// 	config.method = ExUtilGetInt(argv[++c], 0, &parse_error);
 		//   use_lossless_preset = 0;   // disable -z option
 		buf, _, err = img.ExportWebp(&vips.WebpExportParams{
-			Lossless:      true,
-			StripMetadata: true,
+			Lossless:        true,
+			StripMetadata:   true,
+			ReductionEffort: site.WebpMethod,
 		})
 	} else {
-		// If some special images cannot encode with default ReductionEffort(0), then try with 4
+		// If some special images cannot encode with default ReductionEffort(WEBP_METHOD), then try with higher value
 		// Example: https://github.com/webp-sh/webp_server_go/issues/234
+		// NearLossless makes libvips encode in lossless mode with quality as the level of preprocessing
 		ep := vips.WebpExportParams{
 			Quality:       quality,
 			Lossless:      false,
+			NearLossless:  site.WebpNearLossless,
 			StripMetadata: true,
 		}
-		for i := 0; i <= 6; i++ {
+		for i := site.WebpMethod; i <= 6; i++ {
 			ep.ReductionEffort = i
 			buf, _, err = img.ExportWebp(&ep)
 			if err != nil && strings.Contains(err.Error(), "unable to encode") {
@@ -252,6 +396,18 @@ func webpEncoder(p1, p2 string, extraParams config.ExtraParams) error {
 		}
 		buf, _, err = img.ExportWebp(&ep)
 
+		// flat graphics are often smaller in lossless mode, keep the smaller one
+		if err == nil && site.AutoLossless && looksLikeGraphic(img) {
+			losslessBuf, _, losslessErr := img.ExportWebp(&vips.WebpExportParams{
+				Lossless:        true,
+				StripMetadata:   true,
+				ReductionEffort: site.WebpMethod,
+			})
+			if losslessErr == nil && len(losslessBuf) < len(buf) {
+				log.Infof("Lossless WebP of %s is smaller, %d->%d bytes", p1, len(buf), len(losslessBuf))
+				buf = losslessBuf
+			}
+		}
 	}
 
 	if err != nil {
@@ -263,12 +419,162 @@ func webpEncoder(p1, p2 string, extraParams config.ExtraParams) error {
 		log.Error(err)
 		return err
 	}
-	img.Close()
 
 	convertLog("WebP", p1, p2, quality)
 	return nil
 }
 
+func jxlEncoder(p1, p2 string, extraParams config.ExtraParams, site *config.Site) error {
+	// if convert fails, return error; success nil
+	var (
+		buf     []byte
+		quality = qualityOf("jxl", extraParams, site)
+	)
+	img, err := vips.LoadImageFromFile(p1, &vips.ImportParams{
+		FailOnError: boolFalse,
+	})
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	if imageIgnore(img.Format()) {
+		return errors.New("encoder: ignore image type")
+	}
+
+	err = orientImage(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = resizeImage(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = applyEffects(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = applyWatermark(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = applyText(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	// If quality >= 100 or a rule asks for it, we use lossless mode
+	if quality >= 100 || site.Lossless {
+		buf, _, err = img.ExportJxl(&vips.JxlExportParams{
+			Lossless: true,
+			Effort:   site.JxlEffort,
+		})
+	} else {
+		buf, _, err = img.ExportJxl(&vips.JxlExportParams{
+			Quality: quality,
+			Effort:  site.JxlEffort,
+		})
+		// flat graphics are often smaller in lossless mode, keep the smaller one
+		if err == nil && site.AutoLossless && looksLikeGraphic(img) {
+			losslessBuf, _, losslessErr := img.ExportJxl(&vips.JxlExportParams{
+				Lossless: true,
+				Effort:   site.JxlEffort,
+			})
+			if losslessErr == nil && len(losslessBuf) < len(buf) {
+				log.Infof("Lossless JXL of %s is smaller, %d->%d bytes", p1, len(buf), len(losslessBuf))
+				buf = losslessBuf
+			}
+		}
+	}
+
+	if err != nil {
+		log.Warnf("Can't encode source image: %v to JXL", err)
+		return err
+	}
+
+	if err := os.WriteFile(p2, buf, 0600); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	convertLog("JXL", p1, p2, quality)
+	return nil
+}
+
+// legacyEncoder encodes to jpeg or png, for clients that can't handle the optimized formats
+func legacyEncoder(p1, p2, imageType string, extraParams config.ExtraParams, site *config.Site) error {
+	var (
+		buf     []byte
+		quality = qualityOf(imageType, extraParams, site)
+	)
+	img, err := vips.LoadImageFromFile(p1, &vips.ImportParams{
+		FailOnError: boolFalse,
+	})
+	if err != nil {
+		return err
+	}
+	defer img.Close()
+
+	err = orientImage(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = resizeImage(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = applyEffects(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = applyWatermark(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	err = applyText(img, extraParams)
+	if err != nil {
+		return err
+	}
+
+	if imageType == "jpeg" {
+		// jpeg has no alpha channel, transparent pixels would turn black
+		if img.HasAlpha() {
+			if err = img.Flatten(&vips.Color{R: 255, G: 255, B: 255}); err != nil {
+				return err
+			}
+		}
+		buf, _, err = img.ExportJpeg(&vips.JpegExportParams{
+			Quality:       quality,
+			StripMetadata: true,
+		})
+	} else {
+		buf, _, err = img.ExportPng(&vips.PngExportParams{
+			Compression:   6,
+			StripMetadata: true,
+		})
+	}
+	if err != nil {
+		log.Warnf("Can't encode source image: %v to %s", err, imageType)
+		return err
+	}
+
+	if err := os.WriteFile(p2, buf, 0600); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	convertLog(strings.ToUpper(imageType), p1, p2, quality)
+	return nil
+}
+
 func convertLog(itype, p1 string, p2 string, quality int) {
 	oldf, err := os.Stat(p1)
 	if err != nil {
@@ -0,0 +1,116 @@
+package encoder
+
+import (
+	"math"
+	"strings"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// defaultBackground is the letterbox color of contain when no background is given
+var defaultBackground = [4]uint8{255, 255, 255, 255}
+
+// fitImage resizes img into width x height box the way fit asks, see config.Fits
+func fitImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
+	width, height := extraParams.Width, extraParams.Height
+	switch extraParams.Fit {
+	case "contain":
+		if err := img.Thumbnail(width, height, vips.InterestingNone); err != nil {
+			return err
+		}
+		return embedBackground(img, width, height, extraParams)
+	case "fill":
+		return img.ThumbnailWithSize(width, height, vips.InterestingNone, vips.SizeForce)
+	case "inside":
+		return img.Thumbnail(width, height, vips.InterestingNone)
+	case "outside":
+		return thumbnailOutside(img, width, height)
+	default:
+		return cover(img, width, height, extraParams)
+	}
+}
+
+// cover crops img to width x height, keeping the part gravity asks for
+func cover(img *vips.ImageRef, width, height int, extraParams config.ExtraParams) error {
+	switch extraParams.Gravity {
+	case "", "attention":
+		return img.Thumbnail(width, height, vips.InterestingAttention)
+	case "entropy":
+		return img.Thumbnail(width, height, vips.InterestingEntropy)
+	case "center":
+		return img.Thumbnail(width, height, vips.InterestingCentre)
+	}
+
+	if err := thumbnailOutside(img, width, height); err != nil {
+		return err
+	}
+	// rounding of thumbnail may leave a pixel less than asked
+	width, height = clamp(width, 1, img.Width()), clamp(height, 1, img.PageHeight())
+	var left, top int
+	if extraParams.Gravity == "focus" {
+		// put focal point in the middle as long as the window stays inside image
+		left = clamp(int(math.Round(extraParams.FocusX*float64(img.Width())))-width/2, 0, img.Width()-width)
+		top = clamp(int(math.Round(extraParams.FocusY*float64(img.PageHeight())))-height/2, 0, img.PageHeight()-height)
+	} else {
+		left, top = gravityOffset(extraParams.Gravity, img.Width()-width, img.PageHeight()-height)
+	}
+	return img.ExtractArea(left, top, width, height)
+}
+
+// thumbnailOutside resizes img to cover width x height without cropping
+func thumbnailOutside(img *vips.ImageRef, width, height int) error {
+	// thumbnail fits into the box, so make a box of the image's own aspect ratio covering width x height
+	scale := math.Max(float64(width)/float64(img.Width()), float64(height)/float64(img.PageHeight()))
+	return img.Thumbnail(int(math.Ceil(float64(img.Width())*scale)), int(math.Ceil(float64(img.PageHeight())*scale)), vips.InterestingNone)
+}
+
+// embedBackground puts img in a width x height canvas filled with background, centered unless gravity says otherwise
+func embedBackground(img *vips.ImageRef, width, height int, extraParams config.ExtraParams) error {
+	color := defaultBackground
+	if extraParams.Background != "" {
+		color, _ = helper.ParseColor(extraParams.Background)
+	}
+
+	// background has as many values as img has bands, so grey images need to become sRGB to get a color
+	if img.Bands() < 3 {
+		if err := img.ToColorSpace(vips.InterpretationSRGB); err != nil {
+			return err
+		}
+	}
+	if color[3] < 255 {
+		if err := img.AddAlpha(); err != nil {
+			return err
+		}
+	}
+
+	left, top := gravityOffset(extraParams.Gravity, width-img.Width(), height-img.PageHeight())
+	return img.EmbedBackgroundRGBA(left, top, width, height, &vips.ColorRGBA{R: color[0], G: color[1], B: color[2], A: color[3]})
+}
+
+// gravityOffset tells how far to move along free space of dx and dy for a compass gravity, center for others
+func gravityOffset(gravity string, dx, dy int) (int, int) {
+	left, top := dx/2, dy/2
+	if strings.Contains(gravity, "west") {
+		left = 0
+	} else if strings.Contains(gravity, "east") {
+		left = dx
+	}
+	if strings.HasPrefix(gravity, "north") {
+		top = 0
+	} else if strings.HasPrefix(gravity, "south") {
+		top = dy
+	}
+	return left, top
+}
+
+func clamp(v, low, high int) int {
+	if v > high {
+		v = high
+	}
+	if v < low {
+		v = low
+	}
+	return v
+}
@@ -0,0 +1,56 @@
+package encoder
+
+import (
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+const (
+	// images with at most this many colors are considered flat graphics, same as PNG palette limit
+	maxGraphicColors = 256
+	// counting colors needs the decoded pixels, skip it for large images
+	maxColorCountPixels = 2048 * 2048
+)
+
+// looksLikeGraphic tells if img is a screenshot, logo, diagram etc. rather than a photo,
+// lossless encoding is usually smaller and always sharper for those.
+func looksLikeGraphic(img *vips.ImageRef) bool {
+	if img.Format() != vips.ImageTypePNG && img.Format() != vips.ImageTypeGIF {
+		return false
+	}
+	if img.HasAlpha() {
+		return true
+	}
+	for _, field := range img.ImageFields() {
+		// set by libvips for palette PNG, named palette-bit-depth before 8.15
+		if field == "palette" || field == "palette-bit-depth" {
+			return true
+		}
+	}
+	return countColors(img, maxGraphicColors) <= maxGraphicColors
+}
+
+// countColors counts distinct colors of img and stops once limit is exceeded,
+// limit+1 is returned if colors can't be counted.
+func countColors(img *vips.ImageRef, limit int) int {
+	bands := img.Bands()
+	if img.BandFormat() != vips.BandFormatUchar || bands > 4 || img.Width()*img.Height() > maxColorCountPixels {
+		return limit + 1
+	}
+	pixels, err := img.ToBytes()
+	if err != nil {
+		return limit + 1
+	}
+
+	colors := make(map[uint32]struct{}, limit+1)
+	for i := 0; i+bands <= len(pixels); i += bands {
+		var color uint32
+		for b := 0; b < bands; b++ {
+			color = color<<8 | uint32(pixels[i+b])
+		}
+		colors[color] = struct{}{}
+		if len(colors) > limit {
+			break
+		}
+	}
+	return len(colors)
+}
@@ -0,0 +1,67 @@
+package encoder
+
+import (
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+var angles = map[int]vips.Angle{90: vips.Angle90, 180: vips.Angle180, 270: vips.Angle270}
+
+// orientImage applies EXIF orientation unless autorotate=false, then crop, rotate, flip and flop of params.
+// It runs before resizing, so width and height are those of the output image. Crop is in pixels of the
+// image as it's displayed, before rotate param.
+func orientImage(img *vips.ImageRef, extraParams config.ExtraParams) error {
+	if extraParams.NoAutoRotate {
+		// otherwise viewers would still apply the wrong tag
+		if err := img.RemoveOrientation(); err != nil {
+			return err
+		}
+	} else if err := img.AutoRotate(); err != nil {
+		return err
+	}
+	if extraParams.Crop != ([4]float64{}) {
+		left, top, width, height, err := helper.CropArea(extraParams.Crop, img.Width(), img.PageHeight())
+		if err != nil {
+			return err
+		}
+		if err := img.ExtractArea(left, top, width, height); err != nil {
+			return err
+		}
+	}
+	if angle, ok := angles[extraParams.Rotate]; ok {
+		if err := img.Rotate(angle); err != nil {
+			return err
+		}
+	}
+	if extraParams.Flip {
+		if err := img.Flip(vips.DirectionVertical); err != nil {
+			return err
+		}
+	}
+	if extraParams.Flop {
+		if err := img.Flip(vips.DirectionHorizontal); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ImageSize is the size of image at p as it's displayed, after EXIF orientation unless noAutoRotate.
+// Pixels aren't decoded, so it's cheap enough for validating params.
+func ImageSize(p string, noAutoRotate bool) (int, int, error) {
+	img, err := vips.LoadImageFromFile(p, &vips.ImportParams{
+		FailOnError: boolFalse,
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer img.Close()
+	width, height := img.Width(), img.PageHeight()
+	// 5 to 8 are the orientations turning image by 90 or 270 degrees
+	if orientation := img.Orientation(); !noAutoRotate && orientation >= 5 && orientation <= 8 {
+		width, height = height, width
+	}
+	return width, height, nil
+}
@@ -0,0 +1,81 @@
+package encoder
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/png"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/buckket/go-blurhash"
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// PlaceholderKinds are the placeholders that can be asked with placeholder query
+var PlaceholderKinds = []string{"lqip", "blurhash", "thumbhash"}
+
+// Placeholder makes a tiny stand-in of raw to show while the image loads: lqip is a data URI of a ~20px
+// blurred WebP, blurhash and thumbhash are the hashes of the same names. Only orientation and crop of params
+// are applied, size, fit, effects, watermark and text are not.
+func Placeholder(raw, kind string, extraParams config.ExtraParams) (string, error) {
+	img, err := vips.LoadImageFromFile(raw, &vips.ImportParams{
+		FailOnError: boolFalse,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer img.Close()
+	if err := orientImage(img, extraParams); err != nil {
+		return "", err
+	}
+
+	switch kind {
+	case "lqip":
+		if err := img.Thumbnail(20, 20, vips.InterestingNone); err != nil {
+			return "", err
+		}
+		if err := img.GaussianBlur(1); err != nil {
+			return "", err
+		}
+		buf, _, err := img.ExportWebp(&vips.WebpExportParams{
+			Quality:       20,
+			StripMetadata: true,
+		})
+		if err != nil {
+			return "", err
+		}
+		return "data:image/webp;base64," + base64.StdEncoding.EncodeToString(buf), nil
+	case "blurhash":
+		// hash is computed over every pixel, a small image is enough for 4x3 components
+		small, err := thumbnailImage(img, 32)
+		if err != nil {
+			return "", err
+		}
+		return blurhash.Encode(4, 3, small)
+	case "thumbhash":
+		// reference encoder takes images up to 100x100
+		small, err := thumbnailImage(img, 100)
+		if err != nil {
+			return "", err
+		}
+		return base64.StdEncoding.EncodeToString(helper.ThumbHash(small)), nil
+	}
+	return "", errors.New("unknown placeholder " + kind)
+}
+
+// thumbnailImage downscales img to fit size x size and decodes it as image.Image
+func thumbnailImage(img *vips.ImageRef, size int) (image.Image, error) {
+	if err := img.Thumbnail(size, size, vips.InterestingNone); err != nil {
+		return nil, err
+	}
+	buf, _, err := img.ExportPng(&vips.PngExportParams{
+		StripMetadata: true,
+		Compression:   1,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return png.Decode(bytes.NewReader(buf))
+}
@@ -22,10 +22,26 @@ func PrefetchImages() {
 		finishChan <- 1
 	}
 
+	for _, site := range config.AllSites() {
+		if site.ProxyMode {
+			continue
+		}
+		prefetchSite(&site, finishChan)
+	}
+	elapsed := time.Since(sTime)
+	_, _ = fmt.Fprintf(os.Stdout, "Prefetch complete in %s\n\n", elapsed)
+
+}
+
+func prefetchSite(site *config.Site, finishChan chan int) {
 	//prefetch, recursive through the dir
-	all := helper.FileCount(config.Config.ImgPath)
-	var bar = progressbar.Default(all, "Prefetching...")
-	err := filepath.Walk(config.Config.ImgPath,
+	all := helper.FileCount(site.ImgPath)
+	var description = "Prefetching..."
+	if site.Name != "" {
+		description = "Prefetching " + site.Name + "..."
+	}
+	var bar = progressbar.Default(all, description)
+	err := filepath.Walk(site.ImgPath,
 		func(picAbsPath string, info os.FileInfo, err error) error {
 			if err != nil {
 				return err
@@ -33,12 +49,17 @@ func PrefetchImages() {
 			if info.IsDir() {
 				return nil
 			}
-			// RawImagePath string, ImgFilename string, reqURI string
-			metadata := helper.ReadMetadata(picAbsPath, "")
-			avif, webp := helper.GenOptimizedAbsPath(metadata)
+			// metadata is keyed by request path, which is relative to IMG_PATH
+			relPath, _ := filepath.Rel(site.ImgPath, picAbsPath)
+			reqURI := "/" + filepath.ToSlash(relPath)
+			// rules are applied per file as they are per request, on a copy so they don't leak to next file
+			fileSite := *site
+			fileSite.ApplyRule(reqURI)
+			metadata := helper.ReadMetadata(reqURI, "", &fileSite)
+			avif, webp, jxl := helper.GenOptimizedAbsPath(metadata, &fileSite)
 			_ = os.MkdirAll(path.Dir(avif), 0755)
 			log.Infof("Prefetching %s", picAbsPath)
-			go ConvertFilter(picAbsPath, avif, webp, config.ExtraParams{Width: 0, Height: 0}, finishChan)
+			go ConvertFilter(picAbsPath, avif, webp, jxl, config.ExtraParams{Width: 0, Height: 0}, &fileSite, finishChan)
 			_ = bar.Add(<-finishChan)
 			return nil
 		})
@@ -46,7 +67,4 @@ func PrefetchImages() {
 	if err != nil {
 		log.Errorln(err)
 	}
-	elapsed := time.Since(sTime)
-	_, _ = fmt.Fprintf(os.Stdout, "Prefetch complete in %s\n\n", elapsed)
-
 }
@@ -0,0 +1,135 @@
+package encoder
+
+import (
+	"strconv"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+const defaultTextSize = 24
+
+// applyText renders text overlay of params on img with vips_text, after watermark
+func applyText(img *vips.ImageRef, extraParams config.ExtraParams) error {
+	text := extraParams.Text
+	if text.Text == "" {
+		return nil
+	}
+	size, font, gravity := text.Size, text.Font, text.Gravity
+	if size == 0 {
+		size = defaultTextSize
+	}
+	if font == "" {
+		font = "sans"
+	}
+	if gravity == "" {
+		gravity = "southwest"
+	}
+	color := [4]uint8{255, 255, 255, 255}
+	if text.Color != "" {
+		color, _ = helper.ParseColor(text.Color)
+	}
+	padding := 0
+	if text.Background != "" {
+		padding = size / 4
+	}
+	// long text wraps within img
+	maxWidth := img.Width() - 2*text.Margin - 2*padding
+	if maxWidth < size {
+		return nil
+	}
+
+	mask, err := textMask(text.Text, font+" "+strconv.Itoa(size), maxWidth, img.PageHeight())
+	if err != nil || mask == nil {
+		return err
+	}
+	defer mask.Close()
+	if err := mask.Linear1(float64(color[3])/255, 0); err != nil {
+		return err
+	}
+
+	overlay, err := solid(mask.Width(), mask.Height(), [4]uint8{color[0], color[1], color[2], 255})
+	if err != nil {
+		return err
+	}
+	defer overlay.Close()
+	// alpha of text is its mask
+	if err := overlay.ExtractBand(0, 3); err != nil {
+		return err
+	}
+	if err := overlay.BandJoin(mask); err != nil {
+		return err
+	}
+	if err := overlay.Cast(vips.BandFormatUchar); err != nil {
+		return err
+	}
+
+	if text.Background != "" {
+		background, _ := helper.ParseColor(text.Background)
+		box, err := solid(overlay.Width()+2*padding, overlay.Height()+2*padding, background)
+		if err != nil {
+			return err
+		}
+		defer box.Close()
+		if err := box.Composite(overlay, vips.BlendModeOver, padding, padding); err != nil {
+			return err
+		}
+		return stamp(img, box, gravity, text.Margin)
+	}
+	return stamp(img, overlay, gravity, text.Margin)
+}
+
+// textMask renders text in white on black, wrapped at width, and crops it to the text.
+// It's nil when nothing is drawn, e.g. text of spaces.
+func textMask(text, font string, width, height int) (*vips.ImageRef, error) {
+	mask, err := vips.Black(width, height)
+	if err != nil {
+		return nil, err
+	}
+	if err := mask.Label(&vips.LabelParams{
+		Text:      helper.TextMarkup(text),
+		Font:      font,
+		Width:     vips.Scalar{Value: float64(width)},
+		Opacity:   1,
+		Color:     vips.Color{R: 255, G: 255, B: 255},
+		Alignment: vips.AlignLow,
+	}); err != nil {
+		mask.Close()
+		return nil, err
+	}
+	left, top, w, h, err := mask.FindTrim(1, &vips.Color{})
+	if err == nil && (w == 0 || h == 0) {
+		mask.Close()
+		return nil, nil
+	}
+	if err == nil {
+		err = mask.ExtractArea(left, top, w, h)
+	}
+	if err == nil {
+		err = mask.ExtractBand(0, 1)
+	}
+	if err != nil {
+		mask.Close()
+		return nil, err
+	}
+	return mask, nil
+}
+
+// solid is a width x height sRGB image with alpha filled with color
+func solid(width, height int, color [4]uint8) (*vips.ImageRef, error) {
+	img, err := vips.Black(width, height)
+	if err != nil {
+		return nil, err
+	}
+	if err := img.Linear([]float64{0, 0, 0, 0}, []float64{float64(color[0]), float64(color[1]), float64(color[2]), float64(color[3])}); err == nil {
+		err = img.Cast(vips.BandFormatUchar)
+	}
+	if err != nil {
+		img.Close()
+		return nil, err
+	}
+	srgb, err := img.CopyChangingInterpretation(vips.InterpretationSRGB)
+	img.Close()
+	return srgb, err
+}
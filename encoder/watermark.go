@@ -0,0 +1,62 @@
+package encoder
+
+import (
+	"webp_server_go/config"
+
+	"github.com/davidbyttow/govips/v2/vips"
+)
+
+// applyWatermark stamps watermark of params on img after resizing and effects
+func applyWatermark(img *vips.ImageRef, extraParams config.ExtraParams) error {
+	watermark := extraParams.Watermark
+	if watermark.Path == "" {
+		return nil
+	}
+	overlay, err := vips.LoadImageFromFile(watermark.Path, &vips.ImportParams{
+		FailOnError: boolFalse,
+	})
+	if err != nil {
+		return err
+	}
+	defer overlay.Close()
+
+	if watermark.Scale > 0 {
+		if err := overlay.Resize(watermark.Scale*float64(img.Width())/float64(overlay.Width()), vips.KernelAuto); err != nil {
+			return err
+		}
+	}
+	// opacity scales alpha band, so overlay needs to be sRGB with alpha
+	if err := overlay.ToColorSpace(vips.InterpretationSRGB); err != nil {
+		return err
+	}
+	if !overlay.HasAlpha() {
+		if err := overlay.AddAlpha(); err != nil {
+			return err
+		}
+	}
+	if watermark.Opacity > 0 && watermark.Opacity < 1 {
+		if err := overlay.Linear([]float64{1, 1, 1, watermark.Opacity}, []float64{0, 0, 0, 0}); err != nil {
+			return err
+		}
+	}
+
+	gravity := watermark.Gravity
+	if gravity == "" {
+		gravity = "southeast"
+	}
+	return stamp(img, overlay, gravity, watermark.Margin)
+}
+
+// stamp puts sRGB overlay with alpha on img, margin px away from the edges gravity points to
+func stamp(img, overlay *vips.ImageRef, gravity string, margin int) error {
+	left, top := gravityOffset(gravity, img.Width()-overlay.Width()-2*margin, img.PageHeight()-overlay.PageHeight()-2*margin)
+	hadAlpha := img.HasAlpha()
+	if err := img.Composite(overlay, vips.BlendModeOver, left+margin, top+margin); err != nil {
+		return err
+	}
+	// composite always gives alpha, drop it again as img is opaque anyway
+	if !hadAlpha && img.HasAlpha() {
+		return img.ExtractBand(0, img.Bands()-1)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package handler
+
+import (
+	"path"
+	"webp_server_go/config"
+	"webp_server_go/encoder"
+	"webp_server_go/helper"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkFormat validates format query, returns the normalized format or a message for client
+func checkFormat(query string, site *config.Site) (string, string) {
+	format := helper.OutputFormat(query)
+	switch format {
+	case "":
+		return "", "Unknown format " + query
+	case "webp", "avif", "jxl":
+		if !site.FormatEnabled(format) {
+			return "", "Format " + format + " is not enabled"
+		}
+	}
+	return format, ""
+}
+
+// sendFormat serves image in the format asked by client, instead of the smallest one it accepts
+func sendFormat(c *fiber.Ctx, format, rawImageAbs string, metadata config.MetaFile, extraParams config.ExtraParams, site *config.Site) error {
+	if format != "original" {
+		optimized := path.Join(site.ExhaustPath, metadata.Id+"."+format)
+		err := encoder.ConvertTo(rawImageAbs, optimized, format, extraParams, site)
+		if err == nil {
+			c.Set("Content-Type", helper.GetFileContentType(optimized))
+			return c.SendFile(optimized)
+		}
+		log.Warnf("Can't convert %s to %s, serving original image: %v", rawImageAbs, format, err)
+	}
+
+	dest, err := originalImage(rawImageAbs, metadata, extraParams, site)
+	if err != nil {
+		log.Warnf("Can't resize %s itself: %v", rawImageAbs, err)
+		return refuse(c, fiber.StatusInternalServerError, "Can't process image")
+	}
+	c.Set("Content-Type", helper.GetFileContentType(dest))
+	return c.SendFile(dest)
+}
+
+// originalImage is the image served in original format, resized when asked. Watermarked images are
+// made too, so they are never served without watermark.
+func originalImage(rawImageAbs string, metadata config.MetaFile, extraParams config.ExtraParams, site *config.Site) (string, error) {
+	if extraParams == (config.ExtraParams{}) {
+		return rawImageAbs, nil
+	}
+	dest := path.Join(site.ExhaustPath, metadata.Id)
+	if !helper.ImageExists(dest) {
+		if err := encoder.ResizeItself(rawImageAbs, dest, extraParams, site); err != nil {
+			return "", err
+		}
+	}
+	return dest, nil
+}
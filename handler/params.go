@@ -0,0 +1,167 @@
+package handler
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// resolveParams works out params and format of a request from query, path params, preset, signature and headers.
+// pathParams is the /_/<segment>/ of path, either a preset name or params like w_300,h_200.
+// Returned error is a *fiber.Error telling why request is refused.
+func resolveParams(c *fiber.Ctx, site *config.Site, signedPath, pathParams string, query url.Values) (extraParams config.ExtraParams, format string, err error) {
+	var (
+		// requested are the params given by client, before anything is added by server
+		requested config.ExtraParams
+		// signature covers query as sent, path params are part of signedPath already
+		signedQuery = query
+		presetName  string
+	)
+	if _, ok := site.Presets[pathParams]; ok {
+		presetName = pathParams
+	} else if pathParams != "" {
+		pathQuery, parseErr := helper.ParsePathParams(pathParams)
+		if parseErr != nil {
+			return extraParams, "", fiber.NewError(http.StatusBadRequest, "Bad params: "+parseErr.Error())
+		}
+		// query wins over path, like it does over presets
+		for key, value := range query {
+			pathQuery[key] = value
+		}
+		query = pathQuery
+	}
+
+	// explicit format wins over Accept header, checked before metadata is written for it
+	if site.EnableFormatParam && query.Get("format") != "" {
+		var msg string
+		if format, msg = checkFormat(query.Get("format"), site); msg != "" {
+			return extraParams, "", fiber.NewError(http.StatusBadRequest, msg)
+		}
+	}
+
+	// params of client are dropped when disabled, the ones set by server below still apply
+	if site.EnableExtraParams {
+		var parseErr error
+		if requested, parseErr = helper.ParseExtraParams(query); parseErr != nil {
+			return extraParams, "", fiber.NewError(http.StatusBadRequest, "Bad params: "+parseErr.Error())
+		}
+		if site.PresetsOnly && requested != (config.ExtraParams{}) {
+			return extraParams, "", fiber.NewError(http.StatusBadRequest, "Bad params: only presets are allowed")
+		}
+		// anyone could write anything on images otherwise
+		if requested.Text.Text != "" && len(site.SigningKeys) == 0 {
+			return extraParams, "", fiber.NewError(http.StatusBadRequest, "Bad params: text needs SIGNING_KEYS to be set")
+		}
+		// effects of presets are trusted like their sizes
+		if effectErr := helper.CheckEffects(requested, site); effectErr != nil {
+			return extraParams, "", fiber.NewError(http.StatusBadRequest, "Bad params: "+effectErr.Error())
+		}
+	}
+
+	// transformations need a valid signature when SIGNING_KEYS are set, presets don't as they are made by server
+	unsigned := false
+	if len(site.SigningKeys) > 0 {
+		verifyErr := helper.VerifySignature(site.SigningKeys, signedPath, signedQuery, time.Now())
+		unsigned = verifyErr != nil
+		if unsigned && (requested != (config.ExtraParams{}) || format != "") {
+			if site.UnsignedPolicy == config.UnsignedPolicyForbid {
+				return extraParams, "", fiber.NewError(http.StatusForbidden, "Forbidden: "+verifyErr.Error())
+			}
+			log.Infof("Serving %s without transformation: %v", signedPath, verifyErr)
+			requested, format = config.ExtraParams{}, ""
+			query = url.Values{}
+		}
+	}
+
+	extraParams = requested
+	if presetName == "" {
+		presetName = query.Get("preset")
+	}
+	if presetName != "" {
+		preset, ok := site.Presets[presetName]
+		if !ok {
+			return extraParams, "", fiber.NewError(http.StatusBadRequest, "Unknown preset "+presetName)
+		}
+		if !site.EnableExtraParams {
+			query = url.Values{}
+		}
+		if extraParams, err = helper.ApplyPreset(preset, query); err != nil {
+			return extraParams, "", fiber.NewError(http.StatusBadRequest, "Bad params: "+err.Error())
+		}
+	}
+
+	// hints would size images freely, only sizes of presets are encoded with PRESETS_ONLY,
+	// and only signed requests are sized by them when SIGNING_KEYS are set
+	if site.EnableExtraParams && site.EnableClientHints && !site.PresetsOnly && !unsigned {
+		extraParams = helper.ClientHints(extraParams, &c.Request().Header)
+		c.Set("Accept-CH", strings.Join(helper.ClientHintHeaders, ", "))
+		c.Vary(helper.ClientHintVary...)
+	}
+	// dpr of a hint multiplies size asked in query, client can't do anything about the result
+	hintedDpr := requested.Dpr == 0 && extraParams.Dpr > 0
+	extraParams = helper.ResolveDpr(extraParams, site.MaxDpr)
+
+	// sizes of presets are trusted, and sizes picked by client hints are snapped whatever the policy,
+	// only the size client asked for is refused
+	clientSized := requested.Width > 0 || requested.Height > 0
+	constrained, constrainErr := helper.ConstrainSize(extraParams, site)
+	if constrainErr != nil && clientSized && hintedDpr {
+		asked := config.ExtraParams{Width: requested.Width, Height: requested.Height}
+		if _, askedErr := helper.ConstrainSize(asked, site); askedErr != nil {
+			return extraParams, "", fiber.NewError(http.StatusBadRequest, "Bad params: "+askedErr.Error())
+		}
+	} else if constrainErr != nil && clientSized {
+		return extraParams, "", fiber.NewError(http.StatusBadRequest, "Bad params: "+constrainErr.Error())
+	}
+	if constrainErr == nil || clientSized || presetName == "" {
+		extraParams = constrained
+	}
+	extraParams.MaxWidth = constrained.MaxWidth
+
+	if site.SaveDataQuality > 0 {
+		c.Vary("Save-Data")
+		if strings.EqualFold(string(c.Request().Header.Peek("Save-Data")), "on") {
+			extraParams.Quality = site.SaveDataQuality
+			// caps are headers sizing images like client hints, so unsigned requests are left out of them too
+			if !unsigned {
+				// viewport of client hints may cap width already, smaller one wins
+				if site.SaveDataMaxWidth > 0 && (extraParams.MaxWidth == 0 || site.SaveDataMaxWidth < extraParams.MaxWidth) {
+					extraParams.MaxWidth = site.SaveDataMaxWidth
+				}
+				extraParams.MaxHeight = site.SaveDataMaxHeight
+			}
+		}
+	}
+
+	// watermark of site or rule is enforced, a preset can only add one
+	watermarkName := site.Watermark
+	if watermarkName == "" && presetName != "" {
+		watermarkName = site.Presets[presetName].Watermark
+	}
+	if watermarkName != "" {
+		watermark := site.Watermarks[watermarkName]
+		// image must not be served without it
+		if !helper.ImageExists(watermark.Path) {
+			return extraParams, "", fiber.NewError(http.StatusInternalServerError, "Watermark "+watermarkName+" not found: "+watermark.Path)
+		}
+		extraParams.Watermark, extraParams.WatermarkHash = watermark, helper.WatermarkHash(watermark)
+	}
+	// text of site or rule is enforced, a signed text param is used otherwise
+	if site.Text.Text != "" {
+		extraParams.Text = site.Text
+	}
+	return extraParams, format, nil
+}
+
+// refuse answers request with status and msg
+func refuse(c *fiber.Ctx, status int, msg string) error {
+	log.Warn(msg)
+	c.Status(status)
+	return c.Send([]byte(msg))
+}
@@ -0,0 +1,36 @@
+package handler
+
+import (
+	"webp_server_go/config"
+	"webp_server_go/encoder"
+	"webp_server_go/helper"
+
+	"github.com/gofiber/fiber/v2"
+	log "github.com/sirupsen/logrus"
+)
+
+// checkPlaceholder validates placeholder query, returns a message for client if it's unknown
+func checkPlaceholder(kind string) string {
+	for _, k := range encoder.PlaceholderKinds {
+		if k == kind {
+			return ""
+		}
+	}
+	return "Unknown placeholder " + kind
+}
+
+// sendPlaceholder answers placeholder of kind as text, it's made once per source checksum and kept in metadata
+func sendPlaceholder(c *fiber.Ctx, kind, rawImageAbs string, metadata config.MetaFile, extraParams config.ExtraParams, site *config.Site) error {
+	value, ok := helper.ReadPlaceholder(metadata, kind, site)
+	if !ok {
+		var err error
+		if value, err = encoder.Placeholder(rawImageAbs, kind, extraParams); err != nil {
+			log.Warnf("Can't make %s of %s: %v", kind, rawImageAbs, err)
+			return refuse(c, fiber.StatusInternalServerError, "Can't make placeholder")
+		}
+		helper.WritePlaceholder(metadata, kind, value, site)
+	}
+
+	c.Set("Content-Type", fiber.MIMETextPlainCharsetUTF8)
+	return c.SendString(value)
+}
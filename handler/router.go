@@ -1,6 +1,7 @@
 package handler
 
 import (
+	"errors"
 	"net/http"
 	"net/url"
 	"webp_server_go/config"
@@ -8,7 +9,6 @@ import (
 	"webp_server_go/helper"
 
 	"path"
-	"strconv"
 
 	"github.com/gofiber/fiber/v2"
 	log "github.com/sirupsen/logrus"
@@ -21,12 +21,25 @@ func Convert(c *fiber.Ctx) error {
 	// 3. pass it to encoder, get the result, send it back
 
 	var (
-		reqURI, _          = url.QueryUnescape(c.Path())        // /mypic/123.jpg
-		reqURIwithQuery, _ = url.QueryUnescape(c.OriginalURL()) // /mypic/123.jpg?someother=200&somebugs=200
-		filename           = path.Base(reqURI)
+		reqURI, _ = url.QueryUnescape(c.Path()) // /mypic/123.jpg
+		site      = config.SiteFor(c.Hostname())
 	)
 
-	if !helper.CheckAllowedType(filename) {
+	// delete ../ in reqURI to mitigate directory traversal
+	reqURI = path.Clean(reqURI)
+
+	// signature covers path as requested, /_/w_300/123.jpg is then served as /123.jpg?width=300
+	signedPath := reqURI
+	reqURI, pathParams := helper.SplitPathParams(reqURI)
+
+	// rules are matched against cleaned path, so /raw/../avatars/ can't escape /avatars/ rule
+	site.ApplyRule(reqURI)
+	if site.RuleName != "" {
+		c.Set("X-Matched-Rule", site.RuleName)
+	}
+
+	filename := path.Base(reqURI)
+	if !helper.CheckAllowedType(filename, &site) {
 		msg := "File extension not allowed! " + filename
 		log.Warn(msg)
 		c.Status(http.StatusBadRequest)
@@ -34,61 +47,134 @@ func Convert(c *fiber.Ctx) error {
 		return nil
 	}
 
-	// Sometimes reqURIwithQuery can be https://example.tld/mypic/123.jpg?someother=200&somebugs=200, we need to extract it.
-	// delete ../ in reqURI to mitigate directory traversal
-	reqURI = path.Clean(reqURI)
-	reqURIwithQuery = path.Clean(reqURIwithQuery)
-
-	width, _ := strconv.Atoi(c.Query("width"))
-	height, _ := strconv.Atoi(c.Query("height"))
-
-	var extraParams = config.ExtraParams{
-		Width:  width,
-		Height: height,
+	query, _ := url.ParseQuery(string(c.Request().URI().QueryString()))
+	extraParams, format, err := resolveParams(c, &site, signedPath, pathParams, query)
+	if err != nil {
+		var refused *fiber.Error
+		errors.As(err, &refused)
+		return refuse(c, refused.Code, refused.Message)
+	}
+	// placeholder is checked before metadata is written for it, like format
+	var placeholder string
+	if site.EnablePlaceholder && query.Get("placeholder") != "" {
+		placeholder = query.Get("placeholder")
+		if msg := checkPlaceholder(placeholder); msg != "" {
+			return refuse(c, http.StatusBadRequest, msg)
+		}
 	}
 
 	var rawImageAbs string
 	var metadata = config.MetaFile{}
-	if config.ProxyMode {
+	if site.ProxyMode {
 		// this is proxyMode, we'll have to use this url to download and save it to local path, which also gives us rawImageAbs
-		// https://test.webp.sh/mypic/123.jpg?someother=200&somebugs=200
-		metadata = fetchRemoteImg(config.Config.ImgPath + reqURIwithQuery)
-		rawImageAbs = path.Join(config.RemoteRaw, metadata.Id)
+		// https://test.webp.sh/mypic/123.jpg?someother=200, params read by server are left out whether in query or path
+		remoteURL := site.ImgPath + reqURI
+		if remoteQuery := helper.RemoteQuery(query); len(remoteQuery) > 0 {
+			remoteURL += "?" + remoteQuery.Encode()
+		}
+		metadata = fetchRemoteImg(remoteURL, &site)
+		rawImageAbs = path.Join(site.RemoteRawPath, metadata.Id)
 	} else {
 		// not proxyMode, we'll use local path
-		metadata = helper.ReadMetadata(reqURIwithQuery, "")
-		rawImageAbs = path.Join(config.Config.ImgPath, reqURI)
+		rawImageAbs = path.Join(site.ImgPath, reqURI)
+	}
+
+	// Check the original image for existence,
+	if !helper.ImageExists(rawImageAbs) {
+		msg := "image not found"
+		_ = c.Send([]byte(msg))
+		log.Warn(msg)
+		_ = c.SendStatus(404)
+		return nil
+	}
+
+	// crop and caps are checked against source, which is only known now
+	if extraParams.Crop != ([4]float64{}) || extraParams.MaxWidth > 0 || extraParams.MaxHeight > 0 {
+		width, height, err := encoder.ImageSize(rawImageAbs, extraParams.NoAutoRotate)
+		if err == nil && extraParams.Crop != ([4]float64{}) {
+			_, _, width, height, err = helper.CropArea(extraParams.Crop, width, height)
+		}
+		if err != nil && extraParams.Crop != ([4]float64{}) {
+			return refuse(c, http.StatusBadRequest, "Bad params: "+err.Error())
+		}
+		if err == nil {
+			extraParams = helper.DropIdleCaps(extraParams, width, height)
+		}
+	}
+
+	// id is made of params as resolved, so /a.jpg?width=300&dpr=2 shares cache with /a.jpg?width=600,
+	// placeholders only vary with params they follow, so /a.jpg?width=300 and /a.jpg?width=600 share theirs
+	keyParams := extraParams
+	if placeholder != "" {
+		keyParams, format = helper.PlaceholderParams(extraParams), ""
+	}
+	variantKey := helper.ExtraParamsKey(keyParams)
+	if format != "" {
+		variantKey += "&format=" + format
+	}
+	variantURI := reqURI + variantKey
+
+	if site.ProxyMode {
+		// variants are named after id of remote image, so they are cleaned along with it when it changes
+		if variantKey != helper.ExtraParamsKey(config.ExtraParams{}) {
+			metadata.Id += "-" + helper.HashString(variantKey)
+		}
+	} else {
+		metadata = helper.ReadMetadata(variantURI, "", &site)
 		// detect if source file has changed
 		if metadata.Checksum != helper.HashFile(rawImageAbs) {
 			log.Info("Source file has changed, re-encoding...")
-			helper.WriteMetadata(reqURIwithQuery, "")
-			cleanProxyCache(path.Join(config.Config.ExhaustPath, metadata.Id))
+			metadata = helper.WriteMetadata(variantURI, "", &site)
+			cleanProxyCache(path.Join(site.ExhaustPath, metadata.Id))
+		}
+	}
+
+	// placeholder follows orientation and crop of params, it's not resized like the image served with them
+	if placeholder != "" {
+		return sendPlaceholder(c, placeholder, rawImageAbs, metadata, keyParams, &site)
+	}
+
+	// original is served as is only for plain resizing, transformations like rotation, effects, watermark
+	// or text are never dropped, even if the original is smaller
+	servedRaw := rawImageAbs
+	if helper.Transformed(extraParams) {
+		if servedRaw, err = originalImage(rawImageAbs, metadata, extraParams, &site); err != nil {
+			log.Warnf("Can't resize %s itself: %v", rawImageAbs, err)
+			return refuse(c, http.StatusInternalServerError, "Can't process image")
 		}
 	}
 
-	goodFormat := helper.GuessSupportedFormat(&c.Request().Header)
+	// conversion is disabled by rule, serve original image, transformed if needed
+	if site.ConversionDisabled() {
+		return c.SendFile(servedRaw)
+	}
+
+	if format != "" {
+		return sendFormat(c, format, rawImageAbs, metadata, extraParams, &site)
+	}
+
+	var goodFormat []string
+	for _, v := range helper.GuessSupportedFormat(&c.Request().Header) {
+		if v == "raw" || site.FormatEnabled(v) {
+			goodFormat = append(goodFormat, v)
+		}
+	}
 	// resize itself and return if only one format(raw) is supported
 	if len(goodFormat) == 1 {
-		dest := path.Join(config.Config.ExhaustPath, metadata.Id)
+		dest := path.Join(site.ExhaustPath, metadata.Id)
 		if !helper.ImageExists(dest) {
-			encoder.ResizeItself(rawImageAbs, dest, extraParams)
+			if err := encoder.ResizeItself(rawImageAbs, dest, extraParams, &site); err != nil {
+				log.Warnf("Can't resize %s itself: %v", rawImageAbs, err)
+				return refuse(c, http.StatusInternalServerError, "Can't process image")
+			}
 		}
 		return c.SendFile(dest)
 	}
 
-	// Check the original image for existence,
-	if !helper.ImageExists(rawImageAbs) {
-		msg := "image not found"
-		_ = c.Send([]byte(msg))
-		log.Warn(msg)
-		_ = c.SendStatus(404)
-		return nil
-	}
-
-	avifAbs, webpAbs := helper.GenOptimizedAbsPath(metadata)
-	encoder.ConvertFilter(rawImageAbs, avifAbs, webpAbs, extraParams, nil)
+	avifAbs, webpAbs, jxlAbs := helper.GenOptimizedAbsPath(metadata, &site)
+	encoder.ConvertFilter(rawImageAbs, avifAbs, webpAbs, jxlAbs, extraParams, &site, nil)
 
-	var availableFiles = []string{rawImageAbs}
+	var availableFiles = []string{servedRaw}
 	for _, v := range goodFormat {
 		if v == "avif" {
 			availableFiles = append(availableFiles, avifAbs)
@@ -96,6 +182,9 @@ func Convert(c *fiber.Ctx) error {
 		if v == "webp" {
 			availableFiles = append(availableFiles, webpAbs)
 		}
+		if v == "jxl" {
+			availableFiles = append(availableFiles, jxlAbs)
+		}
 	}
 
 	finalFilename := helper.FindSmallestFiles(availableFiles)
@@ -0,0 +1,37 @@
+package helper
+
+import (
+	"fmt"
+	"webp_server_go/config"
+)
+
+// CheckEffects checks effects of params against MAX_BLUR, MAX_SHARPEN and MAX_ADJUSTMENT of site,
+// large sigmas are slow to compute and extreme factors only give black or white images, so factors
+// can't go below 1/MAX_ADJUSTMENT either.
+func CheckEffects(params config.ExtraParams, site *config.Site) error {
+	for _, effect := range []struct {
+		name, limitName string
+		value, limit    float64
+		factor          bool
+	}{
+		{"blur", "MAX_BLUR", params.Blur, site.MaxBlur, false},
+		{"sharpen", "MAX_SHARPEN", params.Sharpen, site.MaxSharpen, false},
+		{"brightness", "MAX_ADJUSTMENT", params.Brightness, site.MaxAdjustment, true},
+		{"contrast", "MAX_ADJUSTMENT", params.Contrast, site.MaxAdjustment, true},
+		{"saturation", "MAX_ADJUSTMENT", params.Saturation, site.MaxAdjustment, true},
+	} {
+		if effect.value == 0 {
+			continue
+		}
+		if effect.limit == 0 {
+			return fmt.Errorf("%s: not allowed", effect.name)
+		}
+		if effect.value > effect.limit {
+			return fmt.Errorf("%s: %g is above %s %g", effect.name, effect.value, effect.limitName, effect.limit)
+		}
+		if effect.factor && effect.value < 1/effect.limit {
+			return fmt.Errorf("%s: %g is below 1/%s %g", effect.name, effect.value, effect.limitName, 1/effect.limit)
+		}
+	}
+	return nil
+}
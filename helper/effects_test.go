@@ -0,0 +1,34 @@
+package helper
+
+import (
+	"net/url"
+	"testing"
+	"webp_server_go/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckEffects(t *testing.T) {
+	site := config.Site{}
+	site.MaxBlur, site.MaxAdjustment = 20, 3
+
+	assert.Nil(t, CheckEffects(config.ExtraParams{Blur: 20, Brightness: 1.5, Grayscale: true}, &site))
+	assert.EqualError(t, CheckEffects(config.ExtraParams{Blur: 25}, &site), "blur: 25 is above MAX_BLUR 20")
+	assert.EqualError(t, CheckEffects(config.ExtraParams{Saturation: 4}, &site), "saturation: 4 is above MAX_ADJUSTMENT 3")
+	assert.EqualError(t, CheckEffects(config.ExtraParams{Brightness: 0.0001}, &site), "brightness: 0.0001 is below 1/MAX_ADJUSTMENT 0.3333333333333333")
+	assert.Nil(t, CheckEffects(config.ExtraParams{Contrast: 0.5}, &site))
+	// 0 disables
+	assert.EqualError(t, CheckEffects(config.ExtraParams{Sharpen: 1}, &site), "sharpen: not allowed")
+}
+
+func TestParseEffects(t *testing.T) {
+	query, _ := url.ParseQuery("blur=5&grayscale=1&contrast=1.2&tint=%23F80")
+	params, err := ParseExtraParams(query)
+	assert.Nil(t, err)
+	assert.Equal(t, config.ExtraParams{Blur: 5, Grayscale: true, Contrast: 1.2, Tint: "ff8800"}, params)
+	assert.Equal(t, "?width=&height=&blur=5&contrast=1.2&grayscale=true&tint=ff8800", ExtraParamsKey(params))
+
+	query, _ = url.ParseQuery("blur=-1&brightness=0")
+	_, err = ParseExtraParams(query)
+	assert.EqualError(t, err, "blur: expected a positive number, got \"-1\"")
+}
@@ -2,10 +2,12 @@ package helper
 
 import (
 	"fmt"
+	"html"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 	"webp_server_go/config"
 
@@ -29,6 +31,8 @@ func GetFileContentType(filename string) string {
 		return "image/webp"
 	} else if strings.HasSuffix(filename, ".avif") {
 		return "image/avif"
+	} else if strings.HasSuffix(filename, ".jxl") {
+		return "image/jxl"
 	} else {
 		// raw image, need to use filetype to determine
 		buf, _ := os.ReadFile(filename)
@@ -83,8 +87,8 @@ func ImageExists(filename string) bool {
 	return !info.IsDir()
 }
 
-func CheckAllowedType(imgFilename string) bool {
-	for _, allowedType := range config.Config.AllowedTypes {
+func CheckAllowedType(imgFilename string, site *config.Site) bool {
+	for _, allowedType := range site.AllowedTypes {
 		if allowedType == "*" {
 			return true
 		}
@@ -96,12 +100,28 @@ func CheckAllowedType(imgFilename string) bool {
 	return false
 }
 
-func GenOptimizedAbsPath(metadata config.MetaFile) (string, string) {
+// OutputFormat normalizes value of format query, empty string is returned for unknown formats
+func OutputFormat(format string) string {
+	format = strings.ToLower(format)
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	for _, f := range config.OutputFormats {
+		if f == format {
+			return f
+		}
+	}
+	return ""
+}
+
+func GenOptimizedAbsPath(metadata config.MetaFile, site *config.Site) (string, string, string) {
 	webpFilename := fmt.Sprintf("%s.webp", metadata.Id)
 	avifFilename := fmt.Sprintf("%s.avif", metadata.Id)
-	webpAbsolutePath := path.Clean(path.Join(config.Config.ExhaustPath, webpFilename))
-	avifAbsolutePath := path.Clean(path.Join(config.Config.ExhaustPath, avifFilename))
-	return avifAbsolutePath, webpAbsolutePath
+	jxlFilename := fmt.Sprintf("%s.jxl", metadata.Id)
+	webpAbsolutePath := path.Clean(path.Join(site.ExhaustPath, webpFilename))
+	avifAbsolutePath := path.Clean(path.Join(site.ExhaustPath, avifFilename))
+	jxlAbsolutePath := path.Clean(path.Join(site.ExhaustPath, jxlFilename))
+	return avifAbsolutePath, webpAbsolutePath, jxlAbsolutePath
 }
 
 func GetCompressionRate(RawImagePath string, optimizedImg string) string {
@@ -125,6 +145,7 @@ func GuessSupportedFormat(header *fasthttp.RequestHeader) []string {
 			"raw":  true,
 			"webp": false,
 			"avif": false,
+			"jxl":  false,
 		}
 
 		ua     = string(header.Peek("user-agent"))
@@ -137,6 +158,10 @@ func GuessSupportedFormat(header *fasthttp.RequestHeader) []string {
 	if strings.Contains(accept, "image/avif") {
 		supported["avif"] = true
 	}
+	// no UA sniffing for jxl, clients decoding it say so
+	if strings.Contains(accept, "image/jxl") {
+		supported["jxl"] = true
+	}
 
 	// chrome on iOS will not send valid image accept header
 	if strings.Contains(ua, "iPhone OS 14") || strings.Contains(ua, "CPU OS 14") ||
@@ -190,3 +215,39 @@ func HashFile(filepath string) string {
 	buf, _ := os.ReadFile(filepath)
 	return fmt.Sprintf("%x", xxhash.Sum64(buf))
 }
+
+// watermarkHashes caches hash of watermark files by path, so they aren't read on every request
+var watermarkHashes sync.Map
+
+type fileHash struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+// WatermarkHash identifies watermark file along with its settings, it goes into cache id of watermarked images
+func WatermarkHash(watermark config.Watermark) string {
+	return HashString(hashFileCached(watermark.Path) + fmt.Sprintf("%+v", watermark))
+}
+
+// hashFileCached is HashFile of filepath, hashed again only when its modification time or size changes
+func hashFileCached(filepath string) string {
+	info, err := os.Stat(filepath)
+	if err != nil {
+		return HashFile(filepath)
+	}
+	if cached, ok := watermarkHashes.Load(filepath); ok {
+		if c := cached.(fileHash); c.modTime.Equal(info.ModTime()) && c.size == info.Size() {
+			return c.hash
+		}
+	}
+	hash := HashFile(filepath)
+	watermarkHashes.Store(filepath, fileHash{modTime: info.ModTime(), size: info.Size(), hash: hash})
+	return hash
+}
+
+// TextMarkup escapes text for vips_text, which parses it as Pango markup, so & or < are drawn as is
+// and text param can't inject markup
+func TextMarkup(text string) string {
+	return html.EscapeString(text)
+}
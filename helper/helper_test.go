@@ -1,24 +1,30 @@
 package helper
 
 import (
+	"os"
+	"path"
 	"testing"
 	"webp_server_go/config"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
 )
 
 func TestMain(m *testing.M) {
-	config.ConfigPath = "../config.json"
+	// paths in config.json are relative to project root
+	_ = os.Chdir("..")
+	config.ConfigPath = "config.json"
 	config.LoadConfig()
+	_ = os.Chdir("helper")
 	m.Run()
 	config.ConfigPath = "config.json"
 
 }
 
 func TestFileCount(t *testing.T) {
-	// test helper dir
-	count := FileCount("./")
-	assert.Equal(t, int64(4), count)
+	// fixtures don't change as helper files are added
+	count := FileCount("../pics/exif-orientation-examples")
+	assert.Equal(t, int64(18), count)
 }
 
 func TestImageExists(t *testing.T) {
@@ -38,11 +44,65 @@ func TestImageExists(t *testing.T) {
 }
 
 func TestCheckAllowedType(t *testing.T) {
+	site := config.DefaultSite()
 	t.Run("not allowed type", func(t *testing.T) {
-		assert.False(t, CheckAllowedType("./helper_test.go"))
+		assert.False(t, CheckAllowedType("./helper_test.go", &site))
 	})
 
 	t.Run("allowed type", func(t *testing.T) {
-		assert.True(t, CheckAllowedType("test.jpg"))
+		assert.True(t, CheckAllowedType("test.jpg", &site))
+	})
+
+	t.Run("site allowed type", func(t *testing.T) {
+		site := config.Site{}
+		site.AllowedTypes = []string{"png"}
+		assert.False(t, CheckAllowedType("test.jpg", &site))
+		assert.True(t, CheckAllowedType("test.PNG", &site))
 	})
 }
+
+func TestGuessSupportedFormat(t *testing.T) {
+	var header fasthttp.RequestHeader
+	header.Set("Accept", "image/jxl,image/avif,image/webp,*/*")
+	assert.ElementsMatch(t, []string{"raw", "webp", "avif", "jxl"}, GuessSupportedFormat(&header))
+
+	header.Set("Accept", "image/webp,*/*")
+	assert.ElementsMatch(t, []string{"raw", "webp"}, GuessSupportedFormat(&header))
+}
+
+func TestGenOptimizedAbsPath(t *testing.T) {
+	site := config.Site{}
+	site.ExhaustPath = "./exhaust"
+	avif, webp, jxl := GenOptimizedAbsPath(config.MetaFile{Id: "abc"}, &site)
+	assert.Equal(t, "exhaust/abc.avif", avif)
+	assert.Equal(t, "exhaust/abc.webp", webp)
+	assert.Equal(t, "exhaust/abc.jxl", jxl)
+}
+
+func TestOutputFormat(t *testing.T) {
+	assert.Equal(t, "avif", OutputFormat("AVIF"))
+	assert.Equal(t, "jpeg", OutputFormat("jpg"))
+	assert.Equal(t, "original", OutputFormat("original"))
+	assert.Equal(t, "", OutputFormat("tiff"))
+}
+
+func TestTextMarkup(t *testing.T) {
+	assert.Equal(t, "© 2024 Foo &amp; Bar", TextMarkup("© 2024 Foo & Bar"))
+	assert.Equal(t, "&lt;b&gt;bold&lt;/b&gt;", TextMarkup("<b>bold</b>"))
+	assert.Equal(t, "SKU 1234", TextMarkup("SKU 1234"))
+}
+
+func TestWatermarkHash(t *testing.T) {
+	logo := path.Join(t.TempDir(), "logo.png")
+	assert.Nil(t, os.WriteFile(logo, []byte("png"), 0600))
+	watermark := config.Watermark{Path: logo, Gravity: "southeast"}
+	hash := WatermarkHash(watermark)
+	assert.Equal(t, hash, WatermarkHash(watermark))
+
+	// a new logo changes size, so it's hashed again
+	assert.Nil(t, os.WriteFile(logo, []byte("new png"), 0600))
+	assert.NotEqual(t, hash, WatermarkHash(watermark))
+
+	watermark.Gravity = "north"
+	assert.NotEqual(t, WatermarkHash(config.Watermark{Path: logo, Gravity: "southeast"}), WatermarkHash(watermark))
+}
@@ -5,58 +5,63 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"time"
 	"webp_server_go/config"
 
 	log "github.com/sirupsen/logrus"
 )
 
-func getId(p string) (string, string, string) {
+func getId(p string, site *config.Site) (string, string, string) {
 	var id string
-	if config.ProxyMode {
+	if site.ProxyMode {
 		return HashString(p), "", ""
 	}
 	parsed, _ := url.Parse(p)
-	width := parsed.Query().Get("width")
-	height := parsed.Query().Get("height")
+	// bad params are skipped, they are refused by handler
+	params := parseKey(parsed.Query())
 	// santizedPath will be /webp_server.jpg?width=200\u0026height= in local mode when requesting /webp_server.jpg?width=200
 	// santizedPath will be https://docs.webp.sh/images/webp_server.jpg?width=400 in proxy mode when requesting /images/webp_server.jpg?width=400 with IMG_PATH = https://docs.webp.sh
-	santizedPath := parsed.Path + "?width=" + width + "&height=" + height
+	santizedPath := parsed.Path + ExtraParamsKey(params)
+	// images of forced format are cached apart, key is kept as is otherwise so existing cache stays valid
+	if format := OutputFormat(parsed.Query().Get("format")); site.EnableFormatParam && format != "" {
+		santizedPath += "&format=" + format
+	}
 	id = HashString(santizedPath)
 
-	return id, path.Join(config.Config.ImgPath, parsed.Path), santizedPath
+	return id, path.Join(site.ImgPath, parsed.Path), santizedPath
 }
 
-func ReadMetadata(p, etag string) config.MetaFile {
+func ReadMetadata(p, etag string, site *config.Site) config.MetaFile {
 	// try to read metadata, if we can't read, create one
 	var metadata config.MetaFile
-	var id, _, _ = getId(p)
+	var id, _, _ = getId(p, site)
 
-	buf, err := os.ReadFile(path.Join(config.Metadata, id+".json"))
+	buf, err := os.ReadFile(path.Join(site.MetadataPath, id+".json"))
 	if err != nil {
 		log.Warnf("can't read metadata: %s", err)
-		WriteMetadata(p, etag)
-		return ReadMetadata(p, etag)
+		WriteMetadata(p, etag, site)
+		return ReadMetadata(p, etag, site)
 	}
 
 	err = json.Unmarshal(buf, &metadata)
 	if err != nil {
 		log.Warnf("unmarshal metadata error, possible corrupt file, re-building...: %s", err)
-		WriteMetadata(p, etag)
-		return ReadMetadata(p, etag)
+		WriteMetadata(p, etag, site)
+		return ReadMetadata(p, etag, site)
 	}
 	return metadata
 }
 
-func WriteMetadata(p, etag string) config.MetaFile {
-	_ = os.Mkdir(config.Metadata, 0755)
+func WriteMetadata(p, etag string, site *config.Site) config.MetaFile {
+	_ = os.MkdirAll(site.MetadataPath, 0755)
 
-	var id, filepath, sant = getId(p)
+	var id, filepath, sant = getId(p, site)
 
 	var data = config.MetaFile{
 		Id: id,
 	}
 
-	if config.ProxyMode {
+	if site.ProxyMode {
 		data.Path = p
 		data.Checksum = HashString(etag)
 	} else {
@@ -65,6 +70,42 @@ func WriteMetadata(p, etag string) config.MetaFile {
 	}
 
 	buf, _ := json.Marshal(data)
-	_ = os.WriteFile(path.Join(config.Metadata, data.Id+".json"), buf, 0644)
+	_ = os.WriteFile(path.Join(site.MetadataPath, data.Id+".json"), buf, 0644)
 	return data
 }
+
+// ReadPlaceholder gives placeholder of kind cached in metadata file of metadata.Id, placeholders made
+// for another checksum are stale and ignored
+func ReadPlaceholder(metadata config.MetaFile, kind string, site *config.Site) (string, bool) {
+	var stored config.MetaFile
+	buf, err := os.ReadFile(path.Join(site.MetadataPath, metadata.Id+".json"))
+	if err != nil || json.Unmarshal(buf, &stored) != nil || stored.Checksum != metadata.Checksum {
+		return "", false
+	}
+	value, ok := stored.Placeholders[kind]
+	return value, ok
+}
+
+// WritePlaceholder caches placeholder of kind in metadata file of metadata.Id, along with others
+// made for the same checksum
+func WritePlaceholder(metadata config.MetaFile, kind, value string, site *config.Site) {
+	_ = os.MkdirAll(site.MetadataPath, 0755)
+	metaPath := path.Join(site.MetadataPath, metadata.Id+".json")
+
+	// placeholders of every kind share the file, so writes are serialized with a lock in WriteLock like downloads,
+	// Add fails while another write holds it. Lock expires so a write that never ends can't block others for good.
+	for config.WriteLock.Add(metaPath, true, time.Minute) != nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer config.WriteLock.Delete(metaPath)
+
+	var stored config.MetaFile
+	metadata.Placeholders = map[string]string{}
+	if buf, err := os.ReadFile(metaPath); err == nil && json.Unmarshal(buf, &stored) == nil && stored.Checksum == metadata.Checksum && stored.Placeholders != nil {
+		metadata.Placeholders = stored.Placeholders
+	}
+	metadata.Placeholders[kind] = value
+
+	buf, _ := json.Marshal(metadata)
+	_ = os.WriteFile(metaPath, buf, 0644)
+}
@@ -3,6 +3,8 @@ package helper
 import (
 	"net/url"
 	"path"
+	"strconv"
+	"sync"
 	"testing"
 	"webp_server_go/config"
 )
@@ -12,8 +14,8 @@ func TestGetId(t *testing.T) {
 
 	t.Run("proxy mode", func(t *testing.T) {
 		// Test case 1: Proxy mode
-		config.ProxyMode = true
-		id, jointPath, santizedPath := getId(p)
+		site := config.Site{ProxyMode: true}
+		id, jointPath, santizedPath := getId(p, &site)
 
 		// Verify the return values
 		expectedId := HashString(p)
@@ -26,18 +28,89 @@ func TestGetId(t *testing.T) {
 	})
 	t.Run("non-proxy mode", func(t *testing.T) {
 		// Test case 2: Non-proxy mode
-		config.ProxyMode = false
+		site := config.DefaultSite()
 		p = "/image.jpg?width=400&height=500"
-		id, jointPath, santizedPath := getId(p)
+		id, jointPath, santizedPath := getId(p, &site)
 
 		// Verify the return values
 		parsed, _ := url.Parse(p)
 		expectedId := HashString(parsed.Path + "?width=400&height=500")
-		expectedPath := path.Join(config.Config.ImgPath, parsed.Path)
+		expectedPath := path.Join(site.ImgPath, parsed.Path)
 		expectedSantizedPath := parsed.Path + "?width=400&height=500"
 		if id != expectedId || jointPath != expectedPath || santizedPath != expectedSantizedPath {
 			t.Errorf("Test case 2 failed: Expected (%s, %s, %s), but got (%s, %s, %s)",
 				expectedId, expectedPath, expectedSantizedPath, id, jointPath, santizedPath)
 		}
 	})
+	t.Run("format query", func(t *testing.T) {
+		site := config.DefaultSite()
+		p = "/image.jpg?width=400&format=JPG"
+		_, _, santizedPath := getId(p, &site)
+		if santizedPath != "/image.jpg?width=400&height=" {
+			t.Errorf("format should be ignored when disabled, got %s", santizedPath)
+		}
+
+		site.EnableFormatParam = true
+		_, _, santizedPath = getId(p, &site)
+		if santizedPath != "/image.jpg?width=400&height=&format=jpeg" {
+			t.Errorf("format should be part of id, got %s", santizedPath)
+		}
+	})
+	t.Run("crop", func(t *testing.T) {
+		site := config.DefaultSite()
+		id, _, _ := getId("/image.jpg?crop=0,0,100,100", &site)
+		otherId, _, _ := getId("/image.jpg?crop=0,0,100,200", &site)
+		if id == otherId {
+			t.Errorf("each crop should be cached apart, got %s for both", id)
+		}
+	})
+}
+
+func TestPlaceholder(t *testing.T) {
+	site := config.DefaultSite()
+	site.MetadataPath = t.TempDir()
+	metadata := config.MetaFile{Id: "id", Path: "/image.jpg", Checksum: "one"}
+
+	if _, ok := ReadPlaceholder(metadata, "blurhash", &site); ok {
+		t.Error("nothing should be cached yet")
+	}
+	WritePlaceholder(metadata, "blurhash", "LEHV6nWB2yk8", &site)
+	WritePlaceholder(metadata, "thumbhash", "1QcSHQRnh493V4dIh4eXh1h4kJUI", &site)
+	if value, _ := ReadPlaceholder(metadata, "blurhash", &site); value != "LEHV6nWB2yk8" {
+		t.Errorf("blurhash should be kept along with thumbhash, got %q", value)
+	}
+	if value, _ := ReadPlaceholder(metadata, "thumbhash", &site); value != "1QcSHQRnh493V4dIh4eXh1h4kJUI" {
+		t.Errorf("thumbhash should be cached, got %q", value)
+	}
+
+	// source changed
+	metadata.Checksum = "two"
+	if _, ok := ReadPlaceholder(metadata, "blurhash", &site); ok {
+		t.Error("placeholder of another checksum should be stale")
+	}
+	WritePlaceholder(metadata, "lqip", "data:image/webp;base64,", &site)
+	if _, ok := ReadPlaceholder(metadata, "thumbhash", &site); ok {
+		t.Error("stale placeholders should be dropped")
+	}
+}
+
+func TestPlaceholderConcurrent(t *testing.T) {
+	site := config.DefaultSite()
+	site.MetadataPath = t.TempDir()
+	metadata := config.MetaFile{Id: "id", Path: "/image.jpg", Checksum: "one"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(kind string) {
+			defer wg.Done()
+			WritePlaceholder(metadata, kind, kind, &site)
+		}(strconv.Itoa(i))
+	}
+	wg.Wait()
+	for i := 0; i < 20; i++ {
+		if _, ok := ReadPlaceholder(metadata, strconv.Itoa(i), &site); !ok {
+			t.Errorf("placeholder %d should survive concurrent writes", i)
+		}
+	}
 }
@@ -0,0 +1,547 @@
+package helper
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"webp_server_go/config"
+
+	"github.com/valyala/fasthttp"
+)
+
+// ParseExtraParams reads transformation params from query, unknown keys are ignored.
+// Bad values are skipped and the first problem is returned, so callers can decide to refuse the request.
+func ParseExtraParams(query url.Values) (config.ExtraParams, error) {
+	var (
+		problem error
+		report  = func(err error) {
+			if problem == nil {
+				problem = err
+			}
+		}
+	)
+
+	// width and height are lenient for compatibility, anything not a number means no resizing
+	width, _ := strconv.Atoi(query.Get("width"))
+	height, _ := strconv.Atoi(query.Get("height"))
+	params := config.ExtraParams{
+		Width:  width,
+		Height: height,
+	}
+
+	if fit := strings.ToLower(query.Get("fit")); fit != "" {
+		if contains(config.Fits, fit) {
+			params.Fit = fit
+		} else {
+			report(fmt.Errorf("fit: unknown value %q, supported values are %s", fit, strings.Join(config.Fits, ", ")))
+		}
+	}
+	if background := query.Get("background"); background != "" {
+		if color, err := ParseColor(background); err == nil {
+			params.Background = hex.EncodeToString(color[:])
+		} else {
+			report(fmt.Errorf("background: %w", err))
+		}
+	}
+	if dpr := query.Get("dpr"); dpr != "" {
+		if f, err := strconv.ParseFloat(dpr, 64); err == nil && f > 0 && !math.IsInf(f, 0) {
+			params.Dpr = f
+		} else {
+			report(fmt.Errorf("dpr: expected a positive number, got %q", dpr))
+		}
+	}
+	if rotate := query.Get("rotate"); rotate != "" {
+		if degrees, err := strconv.Atoi(rotate); err == nil && degrees%90 == 0 {
+			// -90 is 270, 360 is no rotation
+			params.Rotate = (degrees%360 + 360) % 360
+		} else {
+			report(fmt.Errorf("rotate: expected a multiple of 90, got %q", rotate))
+		}
+	}
+	for _, flag := range []struct {
+		name  string
+		value *bool
+	}{{"flip", &params.Flip}, {"flop", &params.Flop}, {"grayscale", &params.Grayscale}} {
+		if b := query.Get(flag.name); b != "" {
+			var err error
+			if *flag.value, err = strconv.ParseBool(b); err != nil {
+				report(fmt.Errorf("%s: expected true or false, got %q", flag.name, b))
+			}
+		}
+	}
+	if autorotate := query.Get("autorotate"); autorotate != "" {
+		if b, err := strconv.ParseBool(autorotate); err == nil {
+			params.NoAutoRotate = !b
+		} else {
+			report(fmt.Errorf("autorotate: expected true or false, got %q", autorotate))
+		}
+	}
+	// limits of effects depend on site, they are checked by CheckEffects
+	for _, effect := range []struct {
+		name  string
+		value *float64
+	}{{"blur", &params.Blur}, {"sharpen", &params.Sharpen}, {"brightness", &params.Brightness}, {"contrast", &params.Contrast}, {"saturation", &params.Saturation}} {
+		if f := query.Get(effect.name); f != "" {
+			if v, err := strconv.ParseFloat(f, 64); err == nil && v > 0 && !math.IsInf(v, 0) {
+				*effect.value = v
+			} else {
+				report(fmt.Errorf("%s: expected a positive number, got %q", effect.name, f))
+			}
+		}
+	}
+	if tint := query.Get("tint"); tint != "" {
+		if color, err := ParseColor(tint); err == nil {
+			params.Tint = hex.EncodeToString(color[:3])
+		} else {
+			report(fmt.Errorf("tint: %w", err))
+		}
+	}
+	if crop := query.Get("crop"); crop != "" {
+		if rect, err := parseCrop(crop); err == nil {
+			params.Crop = rect
+		} else {
+			report(fmt.Errorf("crop: %w", err))
+		}
+	}
+	if text := query.Get("text"); text != "" {
+		params.Text = parseText(query, text, report)
+	}
+	gravity, focus := strings.ToLower(query.Get("gravity")), query.Get("focus")
+	switch {
+	case gravity != "" && focus != "":
+		report(errors.New("gravity: can't be used with focus"))
+	case gravity != "":
+		if contains(config.Gravities, gravity) {
+			params.Gravity = gravity
+		} else {
+			report(fmt.Errorf("gravity: unknown value %q, supported values are %s", gravity, strings.Join(config.Gravities, ", ")))
+		}
+	case focus != "":
+		if x, y, err := parseFocus(focus); err == nil {
+			params.Gravity, params.FocusX, params.FocusY = "focus", x, y
+		} else {
+			report(fmt.Errorf("focus: %w", err))
+		}
+	}
+	return params, problem
+}
+
+// ApplyPreset parses params of preset with params of query on top
+func ApplyPreset(preset config.Preset, query url.Values) (config.ExtraParams, error) {
+	merged := url.Values{}
+	for key, value := range map[string]string{
+		"width":      itoa(preset.Width),
+		"height":     itoa(preset.Height),
+		"fit":        preset.Fit,
+		"background": preset.Background,
+		"gravity":    preset.Gravity,
+		"focus":      preset.Focus,
+		"rotate":     itoa(preset.Rotate),
+		"flip":       btoa(preset.Flip),
+		"flop":       btoa(preset.Flop),
+		"blur":       ftoaOrEmpty(preset.Blur),
+		"sharpen":    ftoaOrEmpty(preset.Sharpen),
+		"grayscale":  btoa(preset.Grayscale),
+		"brightness": ftoaOrEmpty(preset.Brightness),
+		"contrast":   ftoaOrEmpty(preset.Contrast),
+		"saturation": ftoaOrEmpty(preset.Saturation),
+		"tint":       preset.Tint,
+	} {
+		if value != "" {
+			merged.Set(key, value)
+		}
+	}
+	for key, value := range query {
+		merged[key] = value
+	}
+	// gravity and focus can't be used together, the one from query wins
+	if query.Has("gravity") {
+		merged.Del("focus")
+	} else if query.Has("focus") {
+		merged.Del("gravity")
+	}
+
+	params, err := ParseExtraParams(merged)
+	params.Quality = preset.Quality
+	if preset.AutoRotate != nil && !query.Has("autorotate") {
+		params.NoAutoRotate = !*preset.AutoRotate
+	}
+	return params, err
+}
+
+// ClientHintHeaders are the client hints asked with Accept-CH when ENABLE_CLIENT_HINTS is on
+var ClientHintHeaders = []string{"Sec-CH-DPR", "Sec-CH-Width", "Sec-CH-Viewport-Width"}
+
+// ClientHintVary are all headers read by ClientHints, images vary by legacy ones too
+var ClientHintVary = []string{"Sec-CH-DPR", "Sec-CH-Width", "Sec-CH-Viewport-Width", "DPR", "Width", "Viewport-Width"}
+
+// ClientHints fills dpr and width from client hints when query leaves them out, legacy DPR, Width and
+// Viewport-Width headers are read as well. Sec-CH-Width is in physical pixels, so it's turned back into
+// CSS pixels here and multiplied by capped dpr in ResolveDpr like the width param is. Viewport width only
+// caps images that are wider, so unsized images are never upscaled to it.
+func ClientHints(params config.ExtraParams, header *fasthttp.RequestHeader) config.ExtraParams {
+	if params.Dpr == 0 {
+		params.Dpr = clientHint(header, "Sec-CH-DPR", "DPR")
+	}
+	if params.Width > 0 || params.Height > 0 {
+		return params
+	}
+	if width := clientHint(header, "Sec-CH-Width", "Width"); width > 0 {
+		params.Width = int(math.Round(width / math.Max(params.Dpr, 1)))
+	} else if viewport := clientHint(header, "Sec-CH-Viewport-Width", "Viewport-Width"); viewport > 0 {
+		params.MaxWidth = int(math.Round(viewport))
+	}
+	return params
+}
+
+func clientHint(header *fasthttp.RequestHeader, names ...string) float64 {
+	for _, name := range names {
+		if f, err := strconv.ParseFloat(string(header.Peek(name)), 64); err == nil && f > 0 && !math.IsInf(f, 0) {
+			return f
+		}
+	}
+	return 0
+}
+
+// ResolveDpr multiplies width, height and viewport cap by dpr capped at maxDpr, so width=300&dpr=2 shares cache with width=600
+func ResolveDpr(params config.ExtraParams, maxDpr float64) config.ExtraParams {
+	if dpr := math.Min(params.Dpr, maxDpr); dpr > 0 {
+		params.Width = int(math.Round(float64(params.Width) * dpr))
+		params.Height = int(math.Round(float64(params.Height) * dpr))
+		params.MaxWidth = int(math.Round(float64(params.MaxWidth) * dpr))
+	}
+	params.Dpr = 0
+	return params
+}
+
+// DropIdleCaps drops MaxWidth and MaxHeight of params that don't downscale a width x height source, so an
+// unsized request from a wide viewport shares cache with one without client hints. Sized requests keep them.
+func DropIdleCaps(params config.ExtraParams, width, height int) config.ExtraParams {
+	if params.Width > 0 || params.Height > 0 {
+		return params
+	}
+	if params.Rotate == 90 || params.Rotate == 270 {
+		width, height = height, width
+	}
+	if params.MaxWidth >= width {
+		params.MaxWidth = 0
+	}
+	if params.MaxHeight >= height {
+		params.MaxHeight = 0
+	}
+	return params
+}
+
+// Transformed tells if params change image beyond resizing, e.g. rotation, effects, watermark or text.
+// Original image can't be served in place of such variant.
+func Transformed(params config.ExtraParams) bool {
+	resize := config.ExtraParams{
+		Width: params.Width, Height: params.Height, Fit: params.Fit, Background: params.Background,
+		Gravity: params.Gravity, FocusX: params.FocusX, FocusY: params.FocusY, Dpr: params.Dpr,
+		Quality: params.Quality, MaxWidth: params.MaxWidth, MaxHeight: params.MaxHeight,
+	}
+	return params != resize
+}
+
+// PlaceholderParams are the params placeholders follow, so one placeholder serves every size of image
+func PlaceholderParams(params config.ExtraParams) config.ExtraParams {
+	return config.ExtraParams{
+		Rotate: params.Rotate, Flip: params.Flip, Flop: params.Flop, NoAutoRotate: params.NoAutoRotate, Crop: params.Crop,
+	}
+}
+
+// ExtraParamsKey is the part of cache id made of params, every param has a single spelling here so
+// equivalent requests share a cache entry. Plain resizing gives ?width=&height= as older versions did.
+func ExtraParamsKey(params config.ExtraParams) string {
+	var key strings.Builder
+	key.WriteString("?width=" + itoa(params.Width) + "&height=" + itoa(params.Height))
+	if params.Fit != "" {
+		key.WriteString("&fit=" + params.Fit)
+	}
+	if params.Background != "" {
+		key.WriteString("&background=" + params.Background)
+	}
+	if params.Dpr != 0 {
+		key.WriteString("&dpr=" + ftoa(params.Dpr))
+	}
+	if params.Quality != 0 {
+		key.WriteString("&quality=" + strconv.Itoa(params.Quality))
+	}
+	if params.MaxWidth != 0 || params.MaxHeight != 0 {
+		key.WriteString("&max=" + itoa(params.MaxWidth) + "x" + itoa(params.MaxHeight))
+	}
+	if params.Crop != ([4]float64{}) {
+		key.WriteString("&crop=" + ftoa(params.Crop[0]) + "," + ftoa(params.Crop[1]) + "," + ftoa(params.Crop[2]) + "," + ftoa(params.Crop[3]))
+	}
+	if params.Rotate != 0 {
+		key.WriteString("&rotate=" + strconv.Itoa(params.Rotate))
+	}
+	if params.Flip {
+		key.WriteString("&flip=true")
+	}
+	if params.Flop {
+		key.WriteString("&flop=true")
+	}
+	if params.NoAutoRotate {
+		key.WriteString("&autorotate=false")
+	}
+	for _, effect := range []struct {
+		name  string
+		value float64
+	}{{"blur", params.Blur}, {"sharpen", params.Sharpen}, {"brightness", params.Brightness}, {"contrast", params.Contrast}, {"saturation", params.Saturation}} {
+		if effect.value != 0 {
+			key.WriteString("&" + effect.name + "=" + ftoa(effect.value))
+		}
+	}
+	if params.Grayscale {
+		key.WriteString("&grayscale=true")
+	}
+	if params.Tint != "" {
+		key.WriteString("&tint=" + params.Tint)
+	}
+	if params.WatermarkHash != "" {
+		key.WriteString("&watermark=" + params.WatermarkHash)
+	}
+	if params.Text != (config.TextOverlay{}) {
+		key.WriteString("&overlay=" + HashString(fmt.Sprintf("%+v", params.Text)))
+	} else if params.TextHash != "" {
+		key.WriteString("&overlay=" + params.TextHash)
+	}
+	if params.Gravity == "focus" {
+		key.WriteString("&focus=" + ftoa(params.FocusX) + "," + ftoa(params.FocusY))
+	} else if params.Gravity != "" {
+		key.WriteString("&gravity=" + params.Gravity)
+	}
+	return key.String()
+}
+
+// parseKey reads back params written by ExtraParamsKey, including the ones only set by server
+func parseKey(query url.Values) config.ExtraParams {
+	params, _ := ParseExtraParams(query)
+	params.Quality, _ = strconv.Atoi(query.Get("quality"))
+	if width, height, found := strings.Cut(query.Get("max"), "x"); found {
+		params.MaxWidth, _ = strconv.Atoi(width)
+		params.MaxHeight, _ = strconv.Atoi(height)
+	}
+	// watermark and text themselves aren't needed to tell cache id
+	params.WatermarkHash = query.Get("watermark")
+	params.TextHash = query.Get("overlay")
+	return params
+}
+
+// ParseColor parses hex colors like fff, ffffff or ffffff80, leading # is optional, alpha is 255 if left out
+func ParseColor(s string) ([4]uint8, error) {
+	var color = [4]uint8{0, 0, 0, 255}
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != 3 && len(b) != 4 {
+		return color, fmt.Errorf("bad color %q, expected hex like fff, ffffff or ffffff80", s)
+	}
+	copy(color[:], b)
+	return color, nil
+}
+
+// parseCrop parses x,y,w,h in px, or in fractions of source when all of them are at most 1
+func parseCrop(s string) ([4]float64, error) {
+	var rect [4]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return rect, fmt.Errorf("bad crop %q, expected x,y,w,h like 10,20,300,200 or 0.1,0.2,0.5,0.5", s)
+	}
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(part, 64)
+		if err != nil || f < 0 || math.IsInf(f, 0) || i >= 2 && f == 0 {
+			return rect, fmt.Errorf("bad crop %q, expected x,y,w,h like 10,20,300,200 or 0.1,0.2,0.5,0.5", s)
+		}
+		rect[i] = f
+	}
+	if cropInFractions(rect) {
+		if rect[0]+rect[2] > 1 || rect[1]+rect[3] > 1 {
+			return rect, fmt.Errorf("bad crop %q, fractions go beyond the image", s)
+		}
+		return rect, nil
+	}
+	for _, f := range rect {
+		if f != math.Trunc(f) {
+			return rect, fmt.Errorf("bad crop %q, pixels must be whole numbers", s)
+		}
+	}
+	return rect, nil
+}
+
+// CropArea is the area of crop in px of a width x height source, error tells if it goes beyond source
+func CropArea(crop [4]float64, width, height int) (left, top, w, h int, err error) {
+	if cropInFractions(crop) {
+		left = int(math.Min(math.Round(crop[0]*float64(width)), float64(width-1)))
+		top = int(math.Min(math.Round(crop[1]*float64(height)), float64(height-1)))
+		// rounding never makes fractions go beyond source or disappear
+		w = int(math.Max(1, math.Min(math.Round(crop[2]*float64(width)), float64(width-left))))
+		h = int(math.Max(1, math.Min(math.Round(crop[3]*float64(height)), float64(height-top))))
+		return left, top, w, h, nil
+	}
+	left, top, w, h = int(crop[0]), int(crop[1]), int(crop[2]), int(crop[3])
+	if left+w > width || top+h > height {
+		return left, top, w, h, fmt.Errorf("crop: %d,%d,%d,%d goes beyond %dx%d source", left, top, w, h, width, height)
+	}
+	return left, top, w, h, nil
+}
+
+func cropInFractions(crop [4]float64) bool {
+	return crop[0] <= 1 && crop[1] <= 1 && crop[2] <= 1 && crop[3] <= 1
+}
+
+// parseFocus parses x,y in fractions, 0,0 is the top left corner
+func parseFocus(s string) (float64, float64, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) == 2 {
+		x, errX := strconv.ParseFloat(parts[0], 64)
+		y, errY := strconv.ParseFloat(parts[1], 64)
+		if errX == nil && errY == nil && x >= 0 && x <= 1 && y >= 0 && y <= 1 {
+			return x, y, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("bad focal point %q, expected x,y between 0 and 1 like 0.5,0.3", s)
+}
+
+func ftoa(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func itoa(i int) string {
+	if i == 0 {
+		return ""
+	}
+	return strconv.Itoa(i)
+}
+
+// ftoaOrEmpty leaves 0 out like itoa does
+func ftoaOrEmpty(f float64) string {
+	if f == 0 {
+		return ""
+	}
+	return ftoa(f)
+}
+
+// btoa leaves false out like itoa does 0
+func btoa(b bool) string {
+	if b {
+		return "true"
+	}
+	return ""
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// parseText reads text overlay of text param along with textfont, textsize, textcolor, textbg and textgravity
+func parseText(query url.Values, text string, report func(error)) config.TextOverlay {
+	overlay := config.TextOverlay{Font: query.Get("textfont")}
+	if len(text) <= config.MaxTextLength {
+		overlay.Text = text
+	} else {
+		report(fmt.Errorf("text: can't be longer than %d bytes", config.MaxTextLength))
+	}
+	if size := query.Get("textsize"); size != "" {
+		if i, err := strconv.Atoi(size); err == nil && i > 0 && i <= 1000 {
+			overlay.Size = i
+		} else {
+			report(fmt.Errorf("textsize: expected a number between 1 and 1000, got %q", size))
+		}
+	}
+	for _, color := range []struct {
+		name  string
+		value *string
+	}{{"textcolor", &overlay.Color}, {"textbg", &overlay.Background}} {
+		if c := query.Get(color.name); c != "" {
+			if parsed, err := ParseColor(c); err == nil {
+				*color.value = hex.EncodeToString(parsed[:])
+			} else {
+				report(fmt.Errorf("%s: %w", color.name, err))
+			}
+		}
+	}
+	if gravity := strings.ToLower(query.Get("textgravity")); gravity != "" {
+		if contains(config.CompassGravities, gravity) {
+			overlay.Gravity = gravity
+		} else {
+			report(fmt.Errorf("textgravity: unknown value %q, supported values are %s", gravity, strings.Join(config.CompassGravities, ", ")))
+		}
+	}
+	if overlay.Text == "" {
+		return config.TextOverlay{}
+	}
+	return overlay
+}
+
+// PathParamsPrefix starts path form of params, e.g. /_/thumb/a.jpg or /_/w_300,h_200,fit_cover/a.jpg
+const PathParamsPrefix = "/_/"
+
+// SplitPathParams splits /_/w_300/a.jpg into /a.jpg and w_300, for CDNs dropping or reordering query
+func SplitPathParams(p string) (string, string) {
+	rest, found := strings.CutPrefix(p, PathParamsPrefix)
+	if !found {
+		return p, ""
+	}
+	segment, rest, found := strings.Cut(rest, "/")
+	if !found {
+		return p, ""
+	}
+	return "/" + rest, segment
+}
+
+// pathParamNames are the short names of path form, every query param can be spelled in full as well
+var pathParamNames = map[string]string{
+	"w":  "width",
+	"h":  "height",
+	"bg": "background",
+	"g":  "gravity",
+	"f":  "format",
+	"p":  "preset",
+}
+
+// PathParams are the query params that can be given in path form
+var PathParams = []string{"width", "height", "fit", "background", "gravity", "focus", "dpr", "crop", "rotate", "flip", "flop", "autorotate",
+	"blur", "sharpen", "grayscale", "brightness", "contrast", "saturation", "tint",
+	"text", "textfont", "textsize", "textcolor", "textbg", "textgravity", "format", "preset"}
+
+// RemoteQuery is query without the params read by server, in proxy mode it's left on remote url so
+// /_/w_300/a.jpg and /a.jpg?width=300 fetch the same remote image
+func RemoteQuery(query url.Values) url.Values {
+	remote := url.Values{}
+	for key, value := range query {
+		if !contains(PathParams, key) && key != "placeholder" && key != SignatureParam && key != ExpiresParam {
+			remote[key] = value
+		}
+	}
+	return remote
+}
+
+// ParsePathParams turns path form like w_300,h_200,fit_cover into query params. Values holding
+// a comma in query are written with colons instead, e.g. focus_0.5:0.3
+func ParsePathParams(segment string) (url.Values, error) {
+	query := url.Values{}
+	for _, param := range strings.Split(segment, ",") {
+		key, value, found := strings.Cut(param, "_")
+		if name, ok := pathParamNames[key]; ok {
+			key = name
+		}
+		if !found || value == "" || !contains(PathParams, key) {
+			return nil, fmt.Errorf("bad path param %q, expected key_value like w_300", param)
+		}
+		query.Set(key, strings.ReplaceAll(value, ":", ","))
+	}
+	return query, nil
+}
@@ -0,0 +1,257 @@
+package helper
+
+import (
+	"net/url"
+	"testing"
+	"webp_server_go/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestParseExtraParams(t *testing.T) {
+	query, _ := url.ParseQuery("width=300&height=200&fit=Contain&background=%23FFF")
+	params, err := ParseExtraParams(query)
+	assert.Nil(t, err)
+	assert.Equal(t, config.ExtraParams{Width: 300, Height: 200, Fit: "contain", Background: "ffffffff"}, params)
+
+	// bad values are skipped
+	query, _ = url.ParseQuery("width=abc&height=200&fit=crop&background=red")
+	params, err = ParseExtraParams(query)
+	assert.EqualError(t, err, `fit: unknown value "crop", supported values are cover, contain, fill, inside, outside`)
+	assert.Equal(t, config.ExtraParams{Height: 200}, params)
+
+	query, _ = url.ParseQuery("width=300&height=200&gravity=NorthEast")
+	params, err = ParseExtraParams(query)
+	assert.Nil(t, err)
+	assert.Equal(t, "northeast", params.Gravity)
+
+	query, _ = url.ParseQuery("width=300&height=200&focus=0.25,1")
+	params, err = ParseExtraParams(query)
+	assert.Nil(t, err)
+	assert.Equal(t, config.ExtraParams{Width: 300, Height: 200, Gravity: "focus", FocusX: 0.25, FocusY: 1}, params)
+
+	for _, q := range []string{"gravity=top", "focus=0.5", "focus=1.5,0", "gravity=north&focus=0.5,0.5"} {
+		query, _ = url.ParseQuery(q)
+		params, err = ParseExtraParams(query)
+		assert.NotNil(t, err, q)
+		assert.Equal(t, "", params.Gravity, q)
+	}
+}
+
+func TestExtraParamsKey(t *testing.T) {
+	assert.Equal(t, "?width=&height=", ExtraParamsKey(config.ExtraParams{}))
+	assert.Equal(t, "?width=300&height=", ExtraParamsKey(config.ExtraParams{Width: 300}))
+	assert.Equal(t, "?width=300&height=200&fit=contain&background=000000ff",
+		ExtraParamsKey(config.ExtraParams{Width: 300, Height: 200, Fit: "contain", Background: "000000ff"}))
+	assert.Equal(t, "?width=300&height=200&gravity=south", ExtraParamsKey(config.ExtraParams{Width: 300, Height: 200, Gravity: "south"}))
+	assert.Equal(t, "?width=300&height=200&focus=0.25,0.5",
+		ExtraParamsKey(config.ExtraParams{Width: 300, Height: 200, Gravity: "focus", FocusX: 0.25, FocusY: 0.5}))
+}
+
+func TestParseColor(t *testing.T) {
+	color, err := ParseColor("#0af")
+	assert.Nil(t, err)
+	assert.Equal(t, [4]uint8{0, 0xaa, 0xff, 255}, color)
+
+	color, err = ParseColor("11223344")
+	assert.Nil(t, err)
+	assert.Equal(t, [4]uint8{0x11, 0x22, 0x33, 0x44}, color)
+
+	_, err = ParseColor("12345")
+	assert.NotNil(t, err)
+}
+
+func TestParseOrientation(t *testing.T) {
+	query, _ := url.ParseQuery("rotate=-90&flip=true&flop=0&autorotate=false")
+	params, err := ParseExtraParams(query)
+	assert.Nil(t, err)
+	assert.Equal(t, config.ExtraParams{Rotate: 270, Flip: true, NoAutoRotate: true}, params)
+	assert.Equal(t, "?width=&height=&rotate=270&flip=true&autorotate=false", ExtraParamsKey(params))
+
+	// rotating a full turn is no rotation, and shares cache with it
+	query, _ = url.ParseQuery("width=300&rotate=360")
+	params, _ = ParseExtraParams(query)
+	assert.Equal(t, ExtraParamsKey(config.ExtraParams{Width: 300}), ExtraParamsKey(params))
+
+	query, _ = url.ParseQuery("rotate=45&flip=yes")
+	_, err = ParseExtraParams(query)
+	assert.NotNil(t, err)
+}
+
+func TestResolveDpr(t *testing.T) {
+	query, _ := url.ParseQuery("width=300&dpr=2")
+	params, err := ParseExtraParams(query)
+	assert.Nil(t, err)
+	assert.Equal(t, config.ExtraParams{Width: 600}, ResolveDpr(params, 3))
+
+	// capped
+	params = config.ExtraParams{Width: 100, Height: 50, Dpr: 5}
+	assert.Equal(t, config.ExtraParams{Width: 300, Height: 150}, ResolveDpr(params, 3))
+
+	query, _ = url.ParseQuery("width=300&dpr=-1")
+	_, err = ParseExtraParams(query)
+	assert.NotNil(t, err)
+}
+
+func TestTransformed(t *testing.T) {
+	assert.False(t, Transformed(config.ExtraParams{}))
+	assert.False(t, Transformed(config.ExtraParams{Width: 300, Height: 200, Fit: "contain", Quality: 40, MaxWidth: 800}))
+	assert.True(t, Transformed(config.ExtraParams{Width: 300, Rotate: 90}))
+	assert.True(t, Transformed(config.ExtraParams{Grayscale: true}))
+	assert.True(t, Transformed(config.ExtraParams{Crop: [4]float64{0, 0, 0.5, 0.5}}))
+	assert.True(t, Transformed(config.ExtraParams{Text: config.TextOverlay{Text: "© Foo"}}))
+}
+
+func TestDropIdleCaps(t *testing.T) {
+	// caps as wide as source or wider don't change image
+	params := DropIdleCaps(config.ExtraParams{MaxWidth: 1280, MaxHeight: 600}, 800, 600)
+	assert.Equal(t, config.ExtraParams{}, params)
+
+	params = DropIdleCaps(config.ExtraParams{MaxWidth: 640}, 800, 600)
+	assert.Equal(t, 640, params.MaxWidth)
+	// rotated source is 600 wide
+	params = DropIdleCaps(config.ExtraParams{MaxWidth: 640, Rotate: 90}, 800, 600)
+	assert.Equal(t, 0, params.MaxWidth)
+	// output size of sized requests isn't that of source
+	params = DropIdleCaps(config.ExtraParams{Width: 2000, MaxWidth: 1280}, 800, 600)
+	assert.Equal(t, 1280, params.MaxWidth)
+}
+
+func TestPlaceholderParams(t *testing.T) {
+	small := PlaceholderParams(config.ExtraParams{Width: 300, Rotate: 90, Blur: 2, Crop: [4]float64{0, 0, 0.5, 1}})
+	large := PlaceholderParams(config.ExtraParams{Width: 600, Fit: "contain", Rotate: 90, Crop: [4]float64{0, 0, 0.5, 1}})
+	assert.Equal(t, config.ExtraParams{Rotate: 90, Crop: [4]float64{0, 0, 0.5, 1}}, small)
+	assert.Equal(t, ExtraParamsKey(small), ExtraParamsKey(large))
+}
+
+func TestClientHints(t *testing.T) {
+	var header fasthttp.RequestHeader
+	header.Set("Sec-CH-DPR", "2")
+	header.Set("Sec-CH-Width", "900")
+	header.Set("Sec-CH-Viewport-Width", "400")
+
+	// width hint is in physical pixels
+	params := ClientHints(config.ExtraParams{}, &header)
+	assert.Equal(t, config.ExtraParams{Width: 450, Dpr: 2}, params)
+	assert.Equal(t, config.ExtraParams{Width: 900}, ResolveDpr(params, 3))
+
+	// query wins
+	params = ClientHints(config.ExtraParams{Width: 300, Dpr: 1}, &header)
+	assert.Equal(t, config.ExtraParams{Width: 300, Dpr: 1}, params)
+
+	header.Del("Sec-CH-Width")
+	header.Del("Sec-CH-DPR")
+	header.Set("DPR", "1.5")
+	params = ClientHints(config.ExtraParams{}, &header)
+	assert.Equal(t, config.ExtraParams{MaxWidth: 400, Dpr: 1.5}, params)
+	assert.Equal(t, config.ExtraParams{MaxWidth: 600}, ResolveDpr(params, 3))
+
+	// viewport doesn't size images that are only transformed
+	params = ClientHints(config.ExtraParams{Grayscale: true}, &header)
+	assert.Equal(t, 0, params.Width)
+}
+
+func TestParseKey(t *testing.T) {
+	params := config.ExtraParams{Width: 300, Fit: "contain", Background: "ffffffff", Gravity: "north", Quality: 40, MaxWidth: 800, Rotate: 90, Flop: true, WatermarkHash: "5f0c"}
+	query, _ := url.ParseQuery(ExtraParamsKey(params)[1:])
+	assert.Equal(t, params, parseKey(query))
+
+	// Save-Data variant is cached apart
+	assert.NotEqual(t, ExtraParamsKey(config.ExtraParams{Width: 300}), ExtraParamsKey(config.ExtraParams{Width: 300, Quality: 40}))
+}
+
+func TestApplyPreset(t *testing.T) {
+	preset := config.Preset{Width: 200, Height: 200, Fit: "cover", Gravity: "north", Quality: 60}
+	params, err := ApplyPreset(preset, url.Values{})
+	assert.Nil(t, err)
+	assert.Equal(t, config.ExtraParams{Width: 200, Height: 200, Fit: "cover", Gravity: "north", Quality: 60}, params)
+
+	// query goes on top, focus replaces gravity of preset
+	query, _ := url.ParseQuery("width=300&focus=0.5,0.2")
+	params, err = ApplyPreset(preset, query)
+	assert.Nil(t, err)
+	assert.Equal(t, config.ExtraParams{Width: 300, Height: 200, Fit: "cover", Gravity: "focus", FocusX: 0.5, FocusY: 0.2, Quality: 60}, params)
+}
+
+func TestSplitPathParams(t *testing.T) {
+	p, segment := SplitPathParams("/_/thumb/pics/a.jpg")
+	assert.Equal(t, "/pics/a.jpg", p)
+	assert.Equal(t, "thumb", segment)
+
+	p, segment = SplitPathParams("/pics/_/a.jpg")
+	assert.Equal(t, "/pics/_/a.jpg", p)
+	assert.Equal(t, "", segment)
+}
+
+func TestParsePathParams(t *testing.T) {
+	pathQuery, err := ParsePathParams("w_300,h_200,fit_cover,focus_0.5:0.3,bg_fff")
+	assert.Nil(t, err)
+	query, _ := url.ParseQuery("width=300&height=200&fit=cover&focus=0.5,0.3&background=fff")
+	assert.Equal(t, query, pathQuery)
+
+	// both forms share cache
+	fromPath, _ := ParseExtraParams(pathQuery)
+	fromQuery, _ := ParseExtraParams(query)
+	assert.Equal(t, ExtraParamsKey(fromQuery), ExtraParamsKey(fromPath))
+
+	for _, segment := range []string{"w300", "w_", "x_1", "thumb"} {
+		_, err = ParsePathParams(segment)
+		assert.NotNil(t, err, segment)
+	}
+}
+
+func TestRemoteQuery(t *testing.T) {
+	query, _ := url.ParseQuery("width=300&fit=cover&v=2&s=abc&expires=1700000000&placeholder=lqip")
+	assert.Equal(t, url.Values{"v": {"2"}}, RemoteQuery(query))
+	assert.Empty(t, RemoteQuery(url.Values{}))
+}
+
+func TestParseText(t *testing.T) {
+	query, _ := url.ParseQuery("text=SKU+1234&textsize=32&textbg=00000088&textgravity=North")
+	params, err := ParseExtraParams(query)
+	assert.Nil(t, err)
+	assert.Equal(t, config.TextOverlay{Text: "SKU 1234", Size: 32, Background: "00000088", Gravity: "north"}, params.Text)
+
+	// text itself isn't in cache id, but a hash of it
+	key := ExtraParamsKey(params)
+	assert.NotContains(t, key, "SKU")
+	parsed, _ := url.ParseQuery(key[1:])
+	assert.Equal(t, key, ExtraParamsKey(parseKey(parsed)))
+
+	// text settings alone do nothing
+	query, _ = url.ParseQuery("textsize=32")
+	params, _ = ParseExtraParams(query)
+	assert.Equal(t, config.ExtraParams{}, params)
+
+	for _, bad := range []string{"text=a&textcolor=white", "text=a&textgravity=attention"} {
+		query, _ = url.ParseQuery(bad)
+		_, err = ParseExtraParams(query)
+		assert.NotNil(t, err, bad)
+	}
+}
+
+func TestParseCrop(t *testing.T) {
+	query, _ := url.ParseQuery("crop=10,20,300,200")
+	params, err := ParseExtraParams(query)
+	assert.Nil(t, err)
+	assert.Equal(t, [4]float64{10, 20, 300, 200}, params.Crop)
+	assert.Equal(t, "?width=&height=&crop=10,20,300,200", ExtraParamsKey(params))
+
+	for _, crop := range []string{"10,20,300", "10,20,0,200", "0.5,0,0.6,1", "10.5,20,300,200", "-1,0,10,10"} {
+		query, _ = url.ParseQuery("crop=" + crop)
+		_, err = ParseExtraParams(query)
+		assert.NotNil(t, err, crop)
+	}
+}
+
+func TestCropArea(t *testing.T) {
+	left, top, w, h, err := CropArea([4]float64{0.25, 0, 0.5, 1}, 400, 300)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{100, 0, 200, 300}, []int{left, top, w, h})
+
+	_, _, _, _, err = CropArea([4]float64{10, 20, 300, 200}, 400, 300)
+	assert.Nil(t, err)
+	_, _, _, _, err = CropArea([4]float64{200, 20, 300, 200}, 400, 300)
+	assert.EqualError(t, err, "crop: 200,20,300,200 goes beyond 400x300 source")
+}
@@ -0,0 +1,72 @@
+package helper
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	SignatureParam = "s"
+	ExpiresParam   = "expires" // unix timestamp, signature is refused after it
+)
+
+// Signature is HMAC-SHA256 of path and query with key in URL safe base64, s param is left out.
+// Query is sorted, so order of params doesn't matter.
+func Signature(key, p string, query url.Values) string {
+	signed := url.Values{}
+	for k, v := range query {
+		if k != SignatureParam {
+			signed[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(path.Clean(p) + "?" + signed.Encode()))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignURL adds expires and s params to a url like /a.jpg?width=300, expires is left out if ttl is 0
+func SignURL(key, rawURL string, ttl time.Duration, now time.Time) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	query := parsed.Query()
+	query.Del(SignatureParam)
+	query.Del(ExpiresParam)
+	if ttl > 0 {
+		query.Set(ExpiresParam, strconv.FormatInt(now.Add(ttl).Unix(), 10))
+	}
+	query.Set(SignatureParam, Signature(key, parsed.Path, query))
+	parsed.RawQuery = query.Encode()
+	return parsed.String(), nil
+}
+
+// VerifySignature checks s param of query with every key, so a new key can be added before the old one is removed
+func VerifySignature(keys []string, p string, query url.Values, now time.Time) error {
+	signature := query.Get(SignatureParam)
+	if signature == "" {
+		return errors.New("missing signature")
+	}
+	valid := false
+	for _, key := range keys {
+		if hmac.Equal([]byte(signature), []byte(Signature(key, p, query))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return errors.New("bad signature")
+	}
+	if expires := query.Get(ExpiresParam); expires != "" {
+		if t, err := strconv.ParseInt(expires, 10, 64); err != nil || now.Unix() > t {
+			return errors.New("signature expired")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package helper
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignURL(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	signed, err := SignURL("secret", "/a/b.jpg?width=300&fit=cover", 0, now)
+	assert.Nil(t, err)
+	parsed, _ := url.Parse(signed)
+	assert.Equal(t, "/a/b.jpg", parsed.Path)
+	assert.Nil(t, VerifySignature([]string{"old", "secret"}, parsed.Path, parsed.Query(), now))
+	assert.EqualError(t, VerifySignature([]string{"old"}, parsed.Path, parsed.Query(), now), "bad signature")
+
+	// order of params doesn't matter, but every param is signed
+	query := parsed.Query()
+	assert.Nil(t, VerifySignature([]string{"secret"}, "/a/./b.jpg", query, now))
+	query.Set("width", "3000")
+	assert.EqualError(t, VerifySignature([]string{"secret"}, parsed.Path, query, now), "bad signature")
+	query.Del(SignatureParam)
+	assert.EqualError(t, VerifySignature([]string{"secret"}, parsed.Path, query, now), "missing signature")
+
+	signed, _ = SignURL("secret", "/a/b.jpg?width=300", time.Hour, now)
+	parsed, _ = url.Parse(signed)
+	assert.Equal(t, "1700003600", parsed.Query().Get(ExpiresParam))
+	assert.Nil(t, VerifySignature([]string{"secret"}, parsed.Path, parsed.Query(), now.Add(time.Minute)))
+	assert.EqualError(t, VerifySignature([]string{"secret"}, parsed.Path, parsed.Query(), now.Add(2*time.Hour)), "signature expired")
+}
@@ -0,0 +1,64 @@
+package helper
+
+import (
+	"fmt"
+	"math"
+	"webp_server_go/config"
+)
+
+// ConstrainSize checks width and height against ALLOWED_WIDTHS, ALLOWED_HEIGHTS, SIZE_STEP, MIN_SIZE and MAX_SIZE of site,
+// so clients can't fill EXHAUST_PATH with every size there is. Sizes not allowed are snapped to the nearest allowed one
+// with SIZE_POLICY snap, otherwise an error is returned along with the snapped sizes. Cap of viewport is
+// always snapped, it comes from client hints rather than from what client asked.
+func ConstrainSize(params config.ExtraParams, site *config.Site) (config.ExtraParams, error) {
+	var errWidth, errHeight error
+	params.Width, errWidth = constrainSize("width", params.Width, site.AllowedWidths, site)
+	params.Height, errHeight = constrainSize("height", params.Height, site.AllowedHeights, site)
+	params.MaxWidth, _ = constrainSize("width", params.MaxWidth, site.AllowedWidths, site)
+	if errWidth != nil {
+		return params, errWidth
+	}
+	return params, errHeight
+}
+
+func constrainSize(name string, size int, allowed []int, site *config.Site) (int, error) {
+	// 0 means the side follows the aspect ratio
+	if size <= 0 {
+		return size, nil
+	}
+
+	snapped := size
+	if len(allowed) > 0 {
+		snapped = allowed[0]
+		for _, s := range allowed {
+			if abs(s-size) < abs(snapped-size) {
+				snapped = s
+			}
+		}
+	} else if site.SizeStep > 0 {
+		// steps start from MIN_SIZE
+		steps := math.Round(float64(size-site.MinSize) / float64(site.SizeStep))
+		snapped = site.MinSize + int(steps)*site.SizeStep
+	}
+	if snapped < site.MinSize {
+		snapped = site.MinSize
+	}
+	if site.MaxSize > 0 && snapped > site.MaxSize {
+		snapped = site.MaxSize
+	}
+	if snapped <= 0 {
+		snapped = site.SizeStep
+	}
+
+	if snapped != size && site.SizePolicy != config.SizePolicySnap {
+		return snapped, fmt.Errorf("%s: %d is not allowed, nearest allowed is %d", name, size, snapped)
+	}
+	return snapped, nil
+}
+
+func abs(i int) int {
+	if i < 0 {
+		return -i
+	}
+	return i
+}
@@ -0,0 +1,47 @@
+package helper
+
+import (
+	"testing"
+	"webp_server_go/config"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConstrainSize(t *testing.T) {
+	site := config.Site{}
+	site.AllowedWidths = []int{100, 200, 400}
+	site.SizePolicy = config.SizePolicyReject
+
+	params, err := ConstrainSize(config.ExtraParams{Width: 200, Height: 123}, &site)
+	assert.Nil(t, err)
+	assert.Equal(t, config.ExtraParams{Width: 200, Height: 123}, params)
+
+	params, err = ConstrainSize(config.ExtraParams{Width: 290}, &site)
+	assert.EqualError(t, err, "width: 290 is not allowed, nearest allowed is 200")
+	assert.Equal(t, 200, params.Width)
+
+	site.SizePolicy = config.SizePolicySnap
+	params, err = ConstrainSize(config.ExtraParams{Width: 310}, &site)
+	assert.Nil(t, err)
+	assert.Equal(t, 400, params.Width)
+
+	// steps start from MIN_SIZE and stop at MAX_SIZE
+	site = config.Site{}
+	site.SizeStep, site.MinSize, site.MaxSize = 100, 50, 1000
+	site.SizePolicy = config.SizePolicySnap
+	for size, expected := range map[int]int{0: 0, 1: 50, 120: 150, 149: 150, 960: 950, 5000: 1000} {
+		params, err = ConstrainSize(config.ExtraParams{Height: size}, &site)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, params.Height, size)
+	}
+}
+
+func TestConstrainSizeSnapsViewportCap(t *testing.T) {
+	site := config.Site{}
+	site.AllowedWidths = []int{320, 640, 1280}
+	site.SizePolicy = config.SizePolicyReject
+
+	params, err := ConstrainSize(config.ExtraParams{MaxWidth: 1313}, &site)
+	assert.Nil(t, err)
+	assert.Equal(t, 1280, params.MaxWidth)
+}
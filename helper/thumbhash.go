@@ -0,0 +1,142 @@
+package helper
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// ThumbHash encodes img of at most 100x100 into a ThumbHash, see https://evanw.github.io/thumbhash/.
+// Larger images take longer without giving a better hash.
+func ThumbHash(img image.Image) []byte {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	rgba := make([]float64, 0, w*h*4)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			rgba = append(rgba, float64(c.R), float64(c.G), float64(c.B), float64(c.A))
+		}
+	}
+
+	// average color
+	var avgR, avgG, avgB, avgA float64
+	for i := 0; i < len(rgba); i += 4 {
+		alpha := rgba[i+3] / 255
+		avgR += alpha / 255 * rgba[i]
+		avgG += alpha / 255 * rgba[i+1]
+		avgB += alpha / 255 * rgba[i+2]
+		avgA += alpha
+	}
+	if avgA > 0 {
+		avgR, avgG, avgB = avgR/avgA, avgG/avgA, avgB/avgA
+	}
+
+	hasAlpha := avgA < float64(w*h)
+	// fewer luminance bits are left when alpha needs some
+	lLimit := 7.0
+	if hasAlpha {
+		lLimit = 5
+	}
+	longest := float64(maxInt(w, h))
+	lx := maxInt(1, int(roundHalfUp(lLimit*float64(w)/longest)))
+	ly := maxInt(1, int(roundHalfUp(lLimit*float64(h)/longest)))
+
+	// RGBA to LPQA, composited atop average color
+	l, p, q, a := make([]float64, w*h), make([]float64, w*h), make([]float64, w*h), make([]float64, w*h)
+	for i := 0; i < w*h; i++ {
+		alpha := rgba[i*4+3] / 255
+		r := avgR*(1-alpha) + alpha/255*rgba[i*4]
+		g := avgG*(1-alpha) + alpha/255*rgba[i*4+1]
+		b := avgB*(1-alpha) + alpha/255*rgba[i*4+2]
+		l[i] = (r + g + b) / 3
+		p[i] = (r+g)/2 - b
+		q[i] = r - g
+		a[i] = alpha
+	}
+
+	lDc, lAc, lScale := encodeChannel(l, w, h, maxInt(3, lx), maxInt(3, ly))
+	pDc, pAc, pScale := encodeChannel(p, w, h, 3, 3)
+	qDc, qAc, qScale := encodeChannel(q, w, h, 3, 3)
+
+	isLandscape := w > h
+	header24 := int(roundHalfUp(63*lDc)) | int(roundHalfUp(31.5+31.5*pDc))<<6 | int(roundHalfUp(31.5+31.5*qDc))<<12 | int(roundHalfUp(31*lScale))<<18
+	header16 := int(roundHalfUp(63*pScale))<<3 | int(roundHalfUp(63*qScale))<<9
+	if hasAlpha {
+		header24 |= 1 << 23
+	}
+	if isLandscape {
+		header16 |= ly | 1<<15
+	} else {
+		header16 |= lx
+	}
+	hash := []byte{byte(header24), byte(header24 >> 8), byte(header24 >> 16), byte(header16), byte(header16 >> 8)}
+
+	acs := [][]float64{lAc, pAc, qAc}
+	if hasAlpha {
+		aDc, aAc, aScale := encodeChannel(a, w, h, 5, 5)
+		hash = append(hash, byte(int(roundHalfUp(15*aDc))|int(roundHalfUp(15*aScale))<<4))
+		acs = append(acs, aAc)
+	}
+	// AC factors take 4 bits each
+	acStart, acIndex := len(hash), 0
+	for _, ac := range acs {
+		for _, f := range ac {
+			i := acStart + acIndex/2
+			if i == len(hash) {
+				hash = append(hash, 0)
+			}
+			hash[i] |= byte(int(roundHalfUp(15*f)) << ((acIndex & 1) * 4))
+			acIndex++
+		}
+	}
+	return hash
+}
+
+// encodeChannel turns channel into its DC term and AC terms normalized by scale, with DCT
+func encodeChannel(channel []float64, w, h, nx, ny int) (float64, []float64, float64) {
+	var (
+		dc, scale float64
+		ac        []float64
+		fx        = make([]float64, w)
+	)
+	for cy := 0; cy < ny; cy++ {
+		for cx := 0; cx*ny < nx*(ny-cy); cx++ {
+			var f float64
+			for x := 0; x < w; x++ {
+				fx[x] = math.Cos(math.Pi / float64(w) * float64(cx) * (float64(x) + 0.5))
+			}
+			for y := 0; y < h; y++ {
+				fy := math.Cos(math.Pi / float64(h) * float64(cy) * (float64(y) + 0.5))
+				for x := 0; x < w; x++ {
+					f += channel[x+y*w] * fx[x] * fy
+				}
+			}
+			f /= float64(w * h)
+			if cx > 0 || cy > 0 {
+				ac = append(ac, f)
+				scale = math.Max(scale, math.Abs(f))
+			} else {
+				dc = f
+			}
+		}
+	}
+	if scale > 0 {
+		for i := range ac {
+			ac[i] = 0.5 + 0.5/scale*ac[i]
+		}
+	}
+	return dc, ac, scale
+}
+
+// roundHalfUp rounds half up like Math.round of the reference implementation
+func roundHalfUp(f float64) float64 {
+	return math.Floor(f + 0.5)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,28 @@
+package helper
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThumbHash(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for x := 0; x < 10; x++ {
+		for y := 0; y < 10; y++ {
+			img.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	hash := ThumbHash(img)
+	// 5 header bytes of red, then 37 AC factors in 4 bits each
+	assert.Len(t, hash, 24)
+	assert.Equal(t, []byte{213, 251, 3, 7, 0}, hash[:5])
+
+	// alpha adds a byte and alpha factors, landscape is flagged in header
+	wide := image.NewNRGBA(image.Rect(0, 0, 20, 10))
+	hash = ThumbHash(wide)
+	assert.NotZero(t, hash[2]&0x80)
+	assert.NotZero(t, hash[4]&0x80)
+}
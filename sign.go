@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+	"webp_server_go/config"
+	"webp_server_go/helper"
+)
+
+// signCommand prints signed urls for build scripts, e.g.
+// webp-server --config config.json sign -expires 24h /path/to/img.jpg?width=300
+func signCommand(args []string) int {
+	fs := flag.NewFlagSet("sign", flag.ContinueOnError)
+	expires := fs.Duration("expires", 0, "Signature expires after it, e.g. 24h. (Default: never)")
+	host := fs.String("host", "", "Sign with SIGNING_KEYS of the site serving host, taken from url if left out. (Default: top level SIGNING_KEYS)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: webp-server [--config config.json] sign [-expires 24h] [-host example.com] url...")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	for _, rawURL := range fs.Args() {
+		parsed, err := url.Parse(rawURL)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't sign %s: %v\n", rawURL, err)
+			return 1
+		}
+		siteHost := *host
+		if siteHost == "" {
+			siteHost = parsed.Host
+		}
+		site := config.SiteFor(siteHost)
+		if len(site.SigningKeys) == 0 {
+			fmt.Fprintf(os.Stderr, "Can't sign %s: SIGNING_KEYS is not set\n", rawURL)
+			return 1
+		}
+		signed, err := helper.SignURL(site.SigningKeys[0], rawURL, *expires, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Can't sign %s: %v\n", rawURL, err)
+			return 1
+		}
+		fmt.Println(signed)
+	}
+	return 0
+}
@@ -4,7 +4,10 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
+	"time"
 	"webp_server_go/config"
 	"webp_server_go/encoder"
 	"webp_server_go/handler"
@@ -46,11 +49,26 @@ func setupLogger() {
 	log.Infoln("WebP Server Go ready.")
 }
 
+// reloadOnSignal reloads config every time SIGHUP is received
+func reloadOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		log.Info("Received SIGHUP, reloading config...")
+		if err := config.ReloadConfig(); err != nil {
+			log.Error(err)
+		}
+	}
+}
+
 func init() {
 	// main init is the last one to be called
 	flag.Parse()
 	config.LoadConfig()
-	setupLogger()
+	// output of sign command is read by scripts, keep it clean
+	if flag.Arg(0) != "sign" {
+		setupLogger()
+	}
 }
 
 func main() {
@@ -65,8 +83,16 @@ WebP Server Go - v%s
 Develop by WebP Server team. https://github.com/webp-sh`, config.Version)
 
 	// process cli params
-	if config.DumpConfig {
-		fmt.Println(config.SampleConfig)
+	if flag.Arg(0) == "sign" {
+		os.Exit(signCommand(flag.Args()[1:]))
+	}
+	if config.CheckConfig {
+		// LoadConfig has already exited if there is any problem
+		fmt.Printf("Config %s is valid.\n", config.ConfigPath)
+		os.Exit(0)
+	}
+	if config.DumpConfig != "" {
+		fmt.Println(config.SampleConfigOf(config.DumpConfig))
 		os.Exit(0)
 	}
 	if config.DumpSystemd {
@@ -78,10 +104,16 @@ Develop by WebP Server team. https://github.com/webp-sh`, config.Version)
 		os.Exit(0)
 	}
 
+	config.PrepareDirs()
 	if config.Prefetch {
 		go encoder.PrefetchImages()
 	}
 
+	go reloadOnSignal()
+	if config.WatchFile {
+		go config.WatchConfig(2 * time.Second)
+	}
+
 	app.Use(etag.New(etag.Config{
 		Weak: true,
 	}))